@@ -24,7 +24,12 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	_ "github.com/diandianl/p2p-proxy/endpoint/balancer/consistenthash"
+	_ "github.com/diandianl/p2p-proxy/endpoint/balancer/latency"
+	_ "github.com/diandianl/p2p-proxy/endpoint/balancer/leastconn"
 	_ "github.com/diandianl/p2p-proxy/endpoint/balancer/roundrobin"
+	_ "github.com/diandianl/p2p-proxy/protocol/listener/connect"
+	_ "github.com/diandianl/p2p-proxy/protocol/listener/mixed"
 	_ "github.com/diandianl/p2p-proxy/protocol/listener/tcp"
 )
 
@@ -53,8 +58,11 @@ func NewEndpointCmd(ctx context.Context, cfgGetter func(proxy bool) (*config.Con
 		},
 	}
 
-	endpointCmd.Flags().StringP("proxy", "p", "", "proxy server address")
-	viper.BindPFlag("Endpoint.Proxy", endpointCmd.Flags().Lookup("proxy"))
+	endpointCmd.Flags().StringSliceP("proxy", "p", []string{}, "static proxy server address(es), [alias=]multiaddr")
+	viper.BindPFlag("Endpoint.StaticProxies", endpointCmd.Flags().Lookup("proxy"))
+
+	endpointCmd.Flags().String("proxy-mode", "", "proxy mode, one of static, discovery, static_first")
+	viper.BindPFlag("Endpoint.ProxyMode", endpointCmd.Flags().Lookup("proxy-mode"))
 
 	endpointCmd.Flags().String("http", "", "local http(s) proxy agent listen address")
 	viper.BindPFlag("Endpoint.HTTP", endpointCmd.Flags().Lookup("http"))
@@ -0,0 +1,63 @@
+package export
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/endpoint/rule"
+	"github.com/diandianl/p2p-proxy/export"
+
+	"github.com/spf13/cobra"
+)
+
+func NewExportCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	var host string
+
+	var exportCmd = &cobra.Command{
+		Use:       "export {pac|ss|env|clash}",
+		Short:     "Print client configuration for the endpoint listeners",
+		Long:      "Print a PAC file, the shadowsocks URI, shell proxy exports or a Clash config pointing at the endpoint listeners",
+		Args:      cobra.ExactValidArgs(1),
+		ValidArgs: []string{"pac", "ss", "env", "clash"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			cfg, err := cfgGetter(false)
+			if err != nil {
+				return err
+			}
+			rules, err := rule.Load(cfg)
+			if err != nil {
+				return err
+			}
+			listeners := export.Listeners(cfg, host)
+			cipher, password := export.ShadowsocksCredentials(cfg)
+
+			var out []byte
+			switch args[0] {
+			case "pac":
+				out, err = export.PAC(listeners, rules.DirectDomains())
+			case "ss":
+				l, ok := export.First(listeners, export.Shadowsocks)
+				if !ok {
+					return fmt.Errorf("no shadowsocks listener in 'Endpoint.ProxyProtocols'")
+				}
+				out = []byte(export.ShadowsocksURI(l, cipher, password, "p2p-proxy") + "\n")
+			case "env":
+				out, err = export.Env(listeners, rules.DirectDomains())
+			case "clash":
+				out, err = export.Clash(listeners, cipher, password, rules.DirectDomains())
+			}
+			if err != nil {
+				return err
+			}
+			_, err = os.Stdout.Write(out)
+			return err
+		},
+	}
+
+	exportCmd.Flags().StringVar(&host, "host", "", "host clients reach listeners on unspecified addresses at (default 127.0.0.1)")
+
+	return exportCmd
+}
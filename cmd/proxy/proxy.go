@@ -23,6 +23,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	_ "github.com/diandianl/p2p-proxy/protocol/service/connect"
 	_ "github.com/diandianl/p2p-proxy/protocol/service/http"
 	_ "github.com/diandianl/p2p-proxy/protocol/service/shadowsocks"
 	_ "github.com/diandianl/p2p-proxy/protocol/service/socks5"
@@ -21,7 +21,10 @@ import (
 	"os"
 
 	"github.com/diandianl/p2p-proxy/cmd/endpoint"
+	"github.com/diandianl/p2p-proxy/cmd/export"
 	"github.com/diandianl/p2p-proxy/cmd/proxy"
+	"github.com/diandianl/p2p-proxy/cmd/token"
+	"github.com/diandianl/p2p-proxy/cmd/usage"
 	"github.com/diandianl/p2p-proxy/config"
 	"github.com/diandianl/p2p-proxy/log"
 
@@ -103,5 +106,11 @@ func newCommand(ctx context.Context) *cobra.Command {
 
 	cmd.AddCommand(proxy.NewProxyCmd(ctx, cfgGetter))
 
+	cmd.AddCommand(export.NewExportCmd(cfgGetter))
+
+	cmd.AddCommand(token.NewTokenCmd(cfgGetter))
+
+	cmd.AddCommand(usage.NewUsageCmd(cfgGetter))
+
 	return cmd
 }
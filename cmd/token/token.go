@@ -0,0 +1,207 @@
+package token
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/token"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+const defaultKeyFile = "~/.p2p-proxy-operator.key"
+
+func NewTokenCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Issue, inspect and revoke operator signed proxy access tokens",
+	}
+	tokenCmd.AddCommand(newIssueCmd(), newInspectCmd(cfgGetter), newRevokeCmd(cfgGetter))
+	return tokenCmd
+}
+
+func newIssueCmd() *cobra.Command {
+	var (
+		keyFile   string
+		peerID    string
+		protocols []string
+		class     string
+		ttl       time.Duration
+	)
+	issueCmd := &cobra.Command{
+		Use:   "issue",
+		Short: "Issue a token to an endpoint peer, signed by the operator key",
+		Long: "Issue a token to an endpoint peer, signed by the operator key, which is generated on first use. " +
+			"Proxies verify it against the operator public key in 'Proxy.Tokens.OperatorKeys'.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			id, err := peer.Decode(peerID)
+			if err != nil {
+				return fmt.Errorf("invalid peer id [%s]: %s", peerID, err)
+			}
+			if ttl <= 0 {
+				return fmt.Errorf("invalid ttl %s", ttl)
+			}
+			key, err := loadOrGenerateKey(keyFile)
+			if err != nil {
+				return err
+			}
+			pub, err := token.EncodePublicKey(key.GetPublic())
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Operator public key: %s\n", pub)
+
+			now := time.Now().Truncate(time.Second)
+			t, err := token.Issue(key, token.Claims{
+				Peer:      peer.Encode(id),
+				Protocols: protocols,
+				Class:     class,
+				IssuedAt:  now,
+				Expiry:    now.Add(ttl),
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Println(t)
+			return nil
+		},
+	}
+	issueCmd.Flags().StringVar(&keyFile, "key", defaultKeyFile, "operator private key file, generated if missing")
+	issueCmd.Flags().StringVar(&peerID, "peer", "", "endpoint peer id the token is issued to")
+	issueCmd.Flags().StringSliceVar(&protocols, "protocol", nil, "protocol(s) the peer may use (default all)")
+	issueCmd.Flags().StringVar(&class, "class", "", "bandwidth class of the peer")
+	issueCmd.Flags().DurationVar(&ttl, "ttl", 30*24*time.Hour, "validity of the token")
+	issueCmd.MarkFlagRequired("peer")
+	return issueCmd
+}
+
+func newInspectCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect <token>",
+		Short: "Print the claims of a token and verify it against the configured operator keys",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			t, err := token.Parse(args[0])
+			if err != nil {
+				return err
+			}
+			out, err := json.MarshalIndent(&t.Claims, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+
+			v, err := newVerifier(cfgGetter)
+			if err != nil {
+				return err
+			}
+			if err := v.Check(t); err != nil {
+				fmt.Println("Invalid:", err)
+			} else {
+				fmt.Println("Valid")
+			}
+			return nil
+		},
+	}
+}
+
+func newRevokeCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <token|id>",
+		Short: "Add a token to the revocation file of 'Proxy.Tokens.RevocationFile'",
+		Long: "Add a token to the revocation file of 'Proxy.Tokens.RevocationFile', which proxies reload on change. " +
+			"Proxies not sharing the file need a copy of it.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			cfg, err := cfgGetter(true)
+			if err != nil {
+				return err
+			}
+			if len(cfg.Proxy.Tokens.RevocationFile) == 0 {
+				return fmt.Errorf("no 'Proxy.Tokens.RevocationFile' config")
+			}
+			file, err := cfg.ResolvePath(cfg.Proxy.Tokens.RevocationFile)
+			if err != nil {
+				return err
+			}
+
+			line := args[0]
+			if t, err := token.Parse(args[0]); err == nil {
+				line = fmt.Sprintf("%s # peer %s, expires %s", t.ID, t.Peer, t.Expiry.Format(time.RFC3339))
+			} else if _, err := hex.DecodeString(args[0]); err != nil || len(args[0]) == 0 {
+				return fmt.Errorf("neither a token nor a token id [%s]", args[0])
+			}
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintln(f, line); err != nil {
+				f.Close()
+				return err
+			}
+			return f.Close()
+		},
+	}
+}
+
+func newVerifier(cfgGetter func(proxy bool) (*config.Config, error)) (*token.Verifier, error) {
+	cfg, err := cfgGetter(true)
+	if err != nil {
+		return nil, err
+	}
+	c := cfg.Proxy.Tokens
+	var file string
+	if len(c.RevocationFile) > 0 {
+		if file, err = cfg.ResolvePath(c.RevocationFile); err != nil {
+			return nil, err
+		}
+	}
+	return token.NewVerifier(c.OperatorKeys, file)
+}
+
+// loadOrGenerateKey reads the operator key from file, generating it if the file is missing.
+func loadOrGenerateKey(file string) (crypto.PrivKey, error) {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		return config.DecodePrivKey(string(data))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := token.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := config.EncodePrivKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(file, []byte(encoded+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Generated operator key %s\n", file)
+	return key, nil
+}
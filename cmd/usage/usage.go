@@ -0,0 +1,130 @@
+package usage
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/proxy/usage"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/cobra"
+)
+
+func NewUsageCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	var (
+		period string
+		peerID string
+	)
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Report the traffic of endpoint peers in the ledger of 'Proxy.Usage.Ledger'",
+		Long: "Report the bytes in and out and the streams of endpoint peers per protocol in a day or month, " +
+			"from the ledger running proxies save every 'Proxy.Usage.FlushInterval'.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			dir, err := ledgerDir(cfgGetter)
+			if err != nil {
+				return err
+			}
+			if err := checkPeer(peerID); err != nil {
+				return err
+			}
+			records, err := usage.Read(dir, period, peerID)
+			if err != nil {
+				return err
+			}
+			return report(period, records)
+		},
+	}
+	_, month := usage.Periods(time.Now())
+	usageCmd.Flags().StringVar(&period, "period", month, "day like 2006-01-02 or month like 2006-01")
+	usageCmd.Flags().StringVar(&peerID, "peer", "", "only report the endpoint peer")
+	usageCmd.AddCommand(newResetCmd(cfgGetter))
+	return usageCmd
+}
+
+func newResetCmd(cfgGetter func(proxy bool) (*config.Config, error)) *cobra.Command {
+	var (
+		period string
+		peerID string
+		all    bool
+	)
+	resetCmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Reset the usage of endpoint peers in the ledger",
+		Long: "Reset the usage of endpoint peers in the ledger, in a day or month or all of them. " +
+			"Running proxies lift the quotas of the peers when they save the ledger next.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if len(peerID) == 0 && !all {
+				return fmt.Errorf("either --peer or --all is required")
+			}
+			if err := checkPeer(peerID); err != nil {
+				return err
+			}
+			if len(period) > 0 {
+				if _, err := usage.PeriodKind(period); err != nil {
+					return err
+				}
+			}
+			dir, err := ledgerDir(cfgGetter)
+			if err != nil {
+				return err
+			}
+			n, err := usage.Reset(dir, period, peerID)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Reset %d records\n", n)
+			return nil
+		},
+	}
+	resetCmd.Flags().StringVar(&period, "period", "", "day like 2006-01-02 or month like 2006-01 (default all)")
+	resetCmd.Flags().StringVar(&peerID, "peer", "", "endpoint peer to reset")
+	resetCmd.Flags().BoolVar(&all, "all", false, "reset all endpoint peers")
+	return resetCmd
+}
+
+func ledgerDir(cfgGetter func(proxy bool) (*config.Config, error)) (string, error) {
+	cfg, err := cfgGetter(true)
+	if err != nil {
+		return "", err
+	}
+	if len(cfg.Proxy.Usage.Ledger) == 0 {
+		return "", fmt.Errorf("no 'Proxy.Usage.Ledger' config")
+	}
+	return cfg.ResolvePath(cfg.Proxy.Usage.Ledger)
+}
+
+func checkPeer(id string) error {
+	if len(id) == 0 {
+		return nil
+	}
+	if _, err := peer.Decode(id); err != nil {
+		return fmt.Errorf("invalid peer id [%s]: %s", id, err)
+	}
+	return nil
+}
+
+func report(period string, records []usage.Record) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "PEER\tPROTOCOL\tIN\tOUT\tSTREAMS\n")
+	var total usage.Usage
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", r.Peer, r.Protocol,
+			config.FormatSize(r.BytesIn), config.FormatSize(r.BytesOut), r.Streams)
+		total.BytesIn += r.BytesIn
+		total.BytesOut += r.BytesOut
+		total.Streams += r.Streams
+	}
+	fmt.Fprintf(w, "TOTAL %s\t\t%s\t%s\t%d\n", period,
+		config.FormatSize(total.BytesIn), config.FormatSize(total.BytesOut), total.Streams)
+	return w.Flush()
+}
@@ -25,6 +25,20 @@ const (
 	DefaultConfigPath = "~/.p2p-proxy.yaml"
 )
 
+// Endpoint.ProxyMode values
+const (
+	// only use Endpoint.StaticProxies
+	ProxyModeStatic = "static"
+	// only use proxies discovered through the DHT
+	ProxyModeDiscovery = "discovery"
+	// prefer Endpoint.StaticProxies, fall back to discovered proxies when none of them is usable
+	ProxyModeStaticFirst = "static_first"
+)
+
+// DefaultPool names the proxy pool of the top level 'Endpoint' settings,
+// which listeners and rules not naming a pool use.
+const DefaultPool = "default"
+
 var InvalidErr = errors.New("config invalid or not checked")
 
 func init() {
@@ -63,8 +77,22 @@ var Default = &Config{
 				Protocol: "/p2p-proxy/socks5/0.0.1",
 				Config:   map[string]interface{}{},
 			},
+			{
+				Protocol: "/p2p-proxy/connect/0.0.1",
+				Config:   map[string]interface{}{},
+			},
 		},
 		ServiceAdvertiseInterval: time.Hour,
+
+		IdleStreamTimeout: 10 * time.Minute,
+
+		MaxStreams: 0,
+
+		Usage: Usage{
+			FlushInterval: 30 * time.Second,
+			RetainDays:    31,
+			RetainMonths:  12,
+		},
 	},
 	Endpoint: Endpoint{
 		ProxyProtocols: []ProxyProtocol{
@@ -84,7 +112,53 @@ var Default = &Config{
 
 		ServiceDiscoveryInterval: time.Hour,
 
+		ProxyWaitTimeout: 30 * time.Second,
+
 		Balancer: "round_robin",
+
+		StaticProxies: []string{},
+
+		ProxyMode: ProxyModeStaticFirst,
+
+		ProxyCache: ".p2p-proxy-proxies.json",
+
+		Pools: []ProxyPool{},
+
+		Retry: Retry{
+			MaxAttempts:    3,
+			AttemptTimeout: 10 * time.Second,
+			Deadline:       30 * time.Second,
+			Backoff:        100 * time.Millisecond,
+			MaxBackoff:     2 * time.Second,
+			Jitter:         0.2,
+			Evict:          false,
+		},
+
+		Race: Race{
+			Enable:  false,
+			Stagger: 300 * time.Millisecond,
+		},
+
+		Pool: Pool{
+			MinIdle: 0,
+			MaxAge:  2 * time.Minute,
+		},
+
+		Routing: Routing{
+			Default: "proxy",
+			Rules:   []Rule{},
+		},
+
+		PAC: PAC{
+			Listen: "",
+		},
+
+		Health: Health{
+			TTL:         3 * time.Hour,
+			MaxFailures: 3,
+			Backoff:     30 * time.Second,
+			MaxBackoff:  30 * time.Minute,
+		},
 	},
 	Interactive: false,
 }
@@ -110,17 +184,7 @@ func LoadOrInitializeIfNotPresent(configPath string) (cfg *Config, cfgFile strin
 		}
 		return
 	}
-	viper.SetConfigFile(cfgFile)
-	viper.SetConfigType("yaml")
-	viper.AutomaticEnv()
-
-	err = viper.ReadInConfig()
-
-	if err != nil {
-		return
-	}
-	cfg = new(Config)
-	err = viper.Unmarshal(cfg)
+	cfg, err = readConfig(viper.GetViper(), cfgFile)
 	if err != nil {
 		return
 	}
@@ -141,6 +205,35 @@ func LoadOrInitializeIfNotPresent(configPath string) (cfg *Config, cfgFile strin
 	return cfg, cfgFile, nil
 }
 
+func readConfig(v *viper.Viper, cfgFile string) (*Config, error) {
+	v.SetConfigFile(cfgFile)
+	v.SetConfigType("yaml")
+	v.AutomaticEnv()
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	cfg.path = cfgFile
+	return cfg, nil
+}
+
+// Reload reads the config file of c again into a new Config, for the settings applied without restart.
+func (c *Config) Reload() (*Config, error) {
+	if len(c.path) == 0 {
+		return nil, errors.New("config not loaded from a file")
+	}
+	return readConfig(viper.New(), c.path)
+}
+
+// Path returns the config file c was loaded from, empty if none.
+func (c *Config) Path() string {
+	return c.path
+}
+
 func Initialize(cfgPath string) (*Config, error) {
 	var cfg Config = *Default
 
@@ -153,16 +246,32 @@ func Initialize(cfgPath string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	privKey, err := crypto.MarshalPrivateKey(priv)
-
+	cfg.P2P.Identity.PrivKey, err = EncodePrivKey(priv)
 	if err != nil {
 		return nil, err
 	}
-	cfg.P2P.Identity.PrivKey = base64.StdEncoding.EncodeToString(privKey)
 
 	return writeConfig(cfgPath, &cfg)
 }
 
+// EncodePrivKey marshals priv and encodes it like the 'P2P.Identity.PrivKey' config.
+func EncodePrivKey(priv crypto.PrivKey) (string, error) {
+	b, err := crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecodePrivKey decodes a private key encoded by EncodePrivKey.
+func DecodePrivKey(s string) (crypto.PrivKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPrivateKey(b)
+}
+
 func writeConfig(configPath string, cfg *Config) (*Config, error) {
 	data, err := yaml.Marshal(cfg)
 	if err != nil {
@@ -172,6 +281,7 @@ func writeConfig(configPath string, cfg *Config) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	cfg.path = configPath
 	return cfg, nil
 }
 
@@ -191,8 +301,22 @@ type Config struct {
 
 	Interactive bool `yaml:"Interactive"`
 
-	valid      bool `yaml:"-"`
-	work4proxy bool `yaml:"-"`
+	valid      bool   `yaml:"-"`
+	work4proxy bool   `yaml:"-"`
+	path       string `yaml:"-"`
+}
+
+// ResolvePath expands '~' in p and resolves it against
+// the directory of the config file if it is relative.
+func (c *Config) ResolvePath(p string) (string, error) {
+	p, err := homedir.Expand(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(p) || len(c.path) == 0 {
+		return p, nil
+	}
+	return filepath.Join(filepath.Dir(c.path), p), nil
 }
 
 func (c *Config) Validate(proxy bool) error {
@@ -217,12 +341,84 @@ func (c *Config) Validate(proxy bool) error {
 		if len(c.Endpoint.Balancer) == 0 {
 			return fmt.Errorf("no 'Endpoint.Balancer' config")
 		}
+		if err := c.validatePools(); err != nil {
+			return err
+		}
 	}
 	c.valid = true
 	c.work4proxy = proxy
 	return nil
 }
 
+func (c *Config) validatePools() error {
+	names := make(map[string]struct{})
+	for i, pool := range c.ProxyPools() {
+		field := "Endpoint"
+		if i > 0 {
+			field = fmt.Sprintf("Endpoint.Pools[%d]", i-1)
+			if len(pool.Name) == 0 {
+				return fmt.Errorf("no '%s.Name' config", field)
+			}
+		}
+		if _, ok := names[pool.Name]; ok {
+			return fmt.Errorf("duplicate proxy pool [%s]", pool.Name)
+		}
+		names[pool.Name] = struct{}{}
+
+		switch pool.ProxyMode {
+		case "", ProxyModeStaticFirst, ProxyModeDiscovery:
+		case ProxyModeStatic:
+			if len(pool.StaticProxies) == 0 {
+				return fmt.Errorf("no '%s.StaticProxies' config, required by '%s' proxy mode", field, ProxyModeStatic)
+			}
+		default:
+			return fmt.Errorf("unsupported '%s.ProxyMode' [%s]", field, pool.ProxyMode)
+		}
+	}
+	for _, p := range c.Endpoint.ProxyProtocols {
+		if _, ok := names[p.Pool]; !ok && len(p.Pool) > 0 {
+			return fmt.Errorf("unknown proxy pool [%s] of listener [%s]", p.Pool, p.Listen)
+		}
+	}
+	return nil
+}
+
+// ProxyPools returns the default pool made of the top level 'Endpoint' settings, followed
+// by 'Endpoint.Pools', whose unset service tag, balancer and health settings are the default ones.
+func (c *Config) ProxyPools() []ProxyPool {
+	e := &c.Endpoint
+	pools := []ProxyPool{{
+		Name:          DefaultPool,
+		ServiceTag:    c.ServiceTag,
+		StaticProxies: e.StaticProxies,
+		ProxyMode:     e.ProxyMode,
+		Balancer:      e.Balancer,
+		Health:        e.Health,
+	}}
+	for _, pool := range e.Pools {
+		if len(pool.ServiceTag) == 0 {
+			pool.ServiceTag = c.ServiceTag
+		}
+		if len(pool.Balancer) == 0 {
+			pool.Balancer = e.Balancer
+		}
+		if pool.Health.TTL == 0 {
+			pool.Health.TTL = e.Health.TTL
+		}
+		if pool.Health.MaxFailures == 0 {
+			pool.Health.MaxFailures = e.Health.MaxFailures
+		}
+		if pool.Health.Backoff == 0 {
+			pool.Health.Backoff = e.Health.Backoff
+		}
+		if pool.Health.MaxBackoff == 0 {
+			pool.Health.MaxBackoff = e.Health.MaxBackoff
+		}
+		pools = append(pools, pool)
+	}
+	return pools
+}
+
 func (c *Config) Work4Proxy() bool {
 	return c.work4proxy
 }
@@ -281,14 +477,274 @@ type Proxy struct {
 	Protocols []Protocol `yaml:"Protocols"`
 
 	ServiceAdvertiseInterval time.Duration `yaml:"ServiceAdvertiseInterval"`
+
+	// streams sending nothing for this long are reset, endpoints keep idle streams
+	// open for 'Endpoint.Pool.MaxAge' which must be shorter, zero never resets them
+	IdleStreamTimeout time.Duration `yaml:"IdleStreamTimeout"`
+
+	// concurrent streams served per protocol, more are rejected as overloaded, zero is unlimited
+	MaxStreams int `yaml:"MaxStreams"`
+
+	// endpoint peers served by all protocols, each protocol may restrict them further
+	Access Access `yaml:"Access"`
+
+	Tokens Tokens `yaml:"Tokens"`
+
+	// bandwidth of the streams of all protocols, each protocol may limit its streams further,
+	// changes of the config file apply to existing streams without restart
+	RateLimit RateLimit `yaml:"RateLimit"`
+
+	// traffic ledger and volume quotas of endpoint peers
+	Usage Usage `yaml:"Usage"`
+
+	// exit policy of all protocols, each protocol may replace its parts with the
+	// 'EgressAllow', 'EgressDeny' and 'EgressAllowPrivate' keys of its 'Config'
+	Egress Egress `yaml:"Egress"`
+}
+
+// RateLimit limits the bandwidth of streams with token buckets. Rates are sizes per second
+// like 512KB or 10MB, empty for unlimited, and bursts default to one second of their rate.
+type RateLimit struct {
+	// shared by all streams
+	Global Bandwidth `yaml:"Global"`
+
+	// shared by the streams of each endpoint peer
+	PerPeer Bandwidth `yaml:"PerPeer"`
+
+	// in place of 'PerPeer', for the peers whose token has the bandwidth class
+	Classes map[string]Bandwidth `yaml:"Classes,omitempty"`
+}
+
+// Bandwidth is a pair of token bucket rates, uploads are the bytes endpoints send.
+type Bandwidth struct {
+	Upload string `yaml:"Upload"`
+
+	UploadBurst string `yaml:"UploadBurst,omitempty"`
+
+	Download string `yaml:"Download"`
+
+	DownloadBurst string `yaml:"DownloadBurst,omitempty"`
+}
+
+// Usage configures the ledger of the bytes and streams of endpoint peers per protocol,
+// rolled up per day and month of the local time, which 'p2p-proxy usage' reports.
+type Usage struct {
+	// leveldb directory of the ledger, relative to the config file directory, empty disables it
+	Ledger string `yaml:"Ledger"`
+
+	// interval of saving the ledger, which also checks quotas against the resets of 'p2p-proxy usage reset'
+	FlushInterval time.Duration `yaml:"FlushInterval"`
+
+	// days and months whose records are kept, older ones are deleted when the ledger is saved, zero keeps all
+	RetainDays int `yaml:"RetainDays"`
+
+	RetainMonths int `yaml:"RetainMonths"`
+
+	// volume of each endpoint peer, new streams of peers over it are rejected
+	Quota Quota `yaml:"Quota"`
+
+	// in place of 'Quota', for the peers whose token has the bandwidth class
+	Classes map[string]Quota `yaml:"Classes,omitempty"`
+}
+
+// Quota limits the bytes in and out of all protocols, sizes like 10GB, empty for unlimited.
+type Quota struct {
+	Daily string `yaml:"Daily"`
+
+	Monthly string `yaml:"Monthly"`
+}
+
+// Egress decides the targets proxy services dial, checked on the addresses their host resolves to.
+// Rules are hosts with an optional port, e.g. 10.1.0.0/16, [2001:db8::]/32:443, example.com:80, *:25,
+// a domain matches itself and its subdomains as the client names them.
+type Egress struct {
+	// once any rule is given, targets matched by none are denied
+	Allow []string `yaml:"Allow"`
+
+	// denied targets, taking precedence over 'Allow'
+	Deny []string `yaml:"Deny"`
+
+	// dial loopback, link-local, private and other special addresses, which are
+	// otherwise denied unless permitted by an address or CIDR rule of 'Allow'
+	AllowPrivate bool `yaml:"AllowPrivate"`
+}
+
+// Tokens configures the verification of the operator signed tokens endpoints present.
+// A valid token admits its peer in place of the 'Access' allow lists, denied peers stay denied.
+type Tokens struct {
+	// operator public keys, as printed by 'p2p-proxy token issue'
+	OperatorKeys []string `yaml:"OperatorKeys"`
+
+	// refuse endpoints presenting no valid token
+	Require bool `yaml:"Require"`
+
+	// file of revoked token ids, one per line, written by 'p2p-proxy token revoke',
+	// relative to the config file directory and reloaded on change
+	RevocationFile string `yaml:"RevocationFile"`
+}
+
+// Access authorizes endpoint peers by id. Denied peers are refused, and once any peer
+// is allowed by 'Allow' or 'AllowFile', so are all peers not allowed.
+type Access struct {
+	Allow []string `yaml:"Allow"`
+
+	Deny []string `yaml:"Deny"`
+
+	// file of allowed peer ids, one per line, '#' starts a comment, relative to
+	// the config file directory and reloaded on change, a missing file allows none
+	AllowFile string `yaml:"AllowFile"`
 }
 
 type Endpoint struct {
 	ProxyProtocols []ProxyProtocol `yaml:"ProxyProtocols"`
 
+	// operator signed token presented to proxies, as printed by 'p2p-proxy token issue'
+	Token string `yaml:"Token"`
+
 	ServiceDiscoveryInterval time.Duration `yaml:"ServiceDiscoveryInterval"`
 
+	// how long a connection waits for discovery when no proxy is usable
+	ProxyWaitTimeout time.Duration `yaml:"ProxyWaitTimeout"`
+
 	Balancer string `yaml:"Balancer"`
+
+	// proxies dialed directly without discovery, full multiaddrs ending with the proxy
+	// peer id, optionally prefixed by an alias, e.g. tokyo1=/ip4/1.2.3.4/tcp/8888/p2p/QmProxy
+	StaticProxies []string `yaml:"StaticProxies"`
+
+	// one of static, discovery or static_first, default static_first
+	ProxyMode string `yaml:"ProxyMode"`
+
+	// file the known good proxies are saved to and loaded from on start,
+	// relative to the config file directory, empty disables it
+	ProxyCache string `yaml:"ProxyCache"`
+
+	Health Health `yaml:"Health"`
+
+	// named proxy pools besides the default one made of the settings above
+	Pools []ProxyPool `yaml:"Pools"`
+
+	Retry Retry `yaml:"Retry"`
+
+	Race Race `yaml:"Race"`
+
+	Pool Pool `yaml:"Pool"`
+
+	Routing Routing `yaml:"Routing"`
+
+	PAC PAC `yaml:"PAC"`
+}
+
+// ProxyPool is a named set of proxies with its own discovery, balancer and health settings.
+// Listeners, routing rules and client hints pick the pool their connections go out via.
+type ProxyPool struct {
+	Name string `yaml:"Name"`
+
+	// discovery namespace, default 'ServiceTag'
+	ServiceTag string `yaml:"ServiceTag"`
+
+	StaticProxies []string `yaml:"StaticProxies"`
+
+	// ids of the discovered proxies admitted to the pool, empty admits any
+	Peers []string `yaml:"Peers"`
+
+	// one of static, discovery or static_first, default static_first
+	ProxyMode string `yaml:"ProxyMode"`
+
+	// default 'Endpoint.Balancer'
+	Balancer string `yaml:"Balancer"`
+
+	// unset fields default to 'Endpoint.Health'
+	Health Health `yaml:"Health"`
+}
+
+// PAC serves a proxy auto-config file for browsers at http://<Listen>/proxy.pac.
+type PAC struct {
+	// empty disables it
+	Listen string `yaml:"Listen"`
+}
+
+// Routing decides per destination how connections of listeners knowing it are relayed.
+type Routing struct {
+	// action if no rule matches, one of direct, proxy or reject, default proxy
+	Default string `yaml:"Default"`
+
+	Rules []Rule `yaml:"Rules"`
+
+	// YAML file with more 'Rules', matched after the ones above and reloaded on change,
+	// relative to the config file directory
+	RulesFile string `yaml:"RulesFile"`
+
+	// CSV file of 'cidr,country' lines used by the GeoIP conditions, reloaded on change
+	GeoIP string `yaml:"GeoIP"`
+}
+
+// Rule matches if every condition kind it has matches any of its values.
+// Domains are not resolved, so CIDR and GeoIP only match destinations given as IP.
+type Rule struct {
+	DomainSuffix []string `yaml:"DomainSuffix"`
+
+	DomainKeyword []string `yaml:"DomainKeyword"`
+
+	CIDR []string `yaml:"CIDR"`
+
+	// ports or ranges like 8000-9000
+	Ports []string `yaml:"Ports"`
+
+	// country codes
+	GeoIP []string `yaml:"GeoIP"`
+
+	// one of direct, proxy or reject
+	Action string `yaml:"Action"`
+
+	// proxy pool of the proxy action, empty for the default one
+	Pool string `yaml:"Pool,omitempty"`
+}
+
+// Pool keeps streams to the proxies opened in advance, so new local connections
+// do not wait for a stream to be opened and negotiated.
+type Pool struct {
+	// idle streams kept per listener protocol, zero disables the pool
+	MinIdle int `yaml:"MinIdle"`
+	// idle streams older than this are closed and replaced
+	MaxAge time.Duration `yaml:"MaxAge"`
+}
+
+// Race opens streams to two proxies, the second one after a stagger delay,
+// and keeps the first to complete negotiation.
+type Race struct {
+	Enable bool `yaml:"Enable"`
+
+	Stagger time.Duration `yaml:"Stagger"`
+}
+
+type Retry struct {
+	// attempts of opening a stream, each to a freshly picked proxy, also bounds the
+	// streams a connection is replayed on when proxies close it before responding
+	MaxAttempts int `yaml:"MaxAttempts"`
+	// timeout of a single attempt, fields left zero use the defaults, negative ones disable them
+	AttemptTimeout time.Duration `yaml:"AttemptTimeout"`
+	// deadline of all attempts including the backoff between them
+	Deadline time.Duration `yaml:"Deadline"`
+	// delay before the second attempt, doubled before every next one
+	Backoff time.Duration `yaml:"Backoff"`
+
+	MaxBackoff time.Duration `yaml:"MaxBackoff"`
+	// share of the backoff randomly added or removed, between 0 and 1
+	Jitter float64 `yaml:"Jitter"`
+	// evict a failing proxy at once rather than only counting the failure
+	Evict bool `yaml:"Evict"`
+}
+
+type Health struct {
+	// proxies not discovered again within TTL are dropped
+	TTL time.Duration `yaml:"TTL"`
+	// consecutive failures before a proxy is evicted
+	MaxFailures int `yaml:"MaxFailures"`
+	// delay before an evicted proxy is re-admitted, doubled on every eviction in a row
+	Backoff time.Duration `yaml:"Backoff"`
+
+	MaxBackoff time.Duration `yaml:"MaxBackoff"`
 }
 
 type Identity struct {
@@ -310,12 +766,18 @@ type DHT struct {
 type ProxyProtocol struct {
 	Protocol string `yaml:"Protocol"`
 	Listen   string `yaml:"Listen"`
-	// Config   map[string]interface{} `yaml:"Config"`
+	// proxy pool the connections go out via, empty for the default one
+	Pool   string                 `yaml:"Pool,omitempty"`
+	Config map[string]interface{} `yaml:"Config"`
 }
 
 type Protocol struct {
 	Protocol string                 `yaml:"Protocol"`
 	Config   map[string]interface{} `yaml:"Config"`
+	// endpoint peers served by the protocol, besides passing 'Proxy.Access'
+	Access Access `yaml:"Access,omitempty"`
+	// bandwidth of the streams of the protocol, besides 'Proxy.RateLimit'
+	RateLimit RateLimit `yaml:"RateLimit,omitempty"`
 }
 
 type Logging struct {
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a size in bytes like 512KB, 1.5GB or 1024, units are powers of 1024.
+// An empty size is zero.
+func ParseSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	if len(upper) == 0 {
+		return 0, nil
+	}
+	number, unit := upper, 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			number, unit = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size [%s]", s)
+	}
+	return int64(n * unit), nil
+}
+
+// FormatSize formats n bytes like ParseSize parses them, with up to two decimals.
+func FormatSize(n int64) string {
+	for _, u := range sizeUnits[:4] {
+		if float64(n) >= u.bytes {
+			return strings.TrimSuffix(strings.TrimRight(strconv.FormatFloat(float64(n)/u.bytes, 'f', 2, 64), "0"), ".") + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// WatchFile calls onChange whenever the modification time or size of file changed,
+// checking every interval until ctx is done. A missing file counts as a change once.
+func WatchFile(ctx context.Context, file string, interval time.Duration, onChange func()) {
+	last, _ := os.Stat(file)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		info, _ := os.Stat(file)
+		if changed(last, info) {
+			last = info
+			onChange()
+		}
+	}
+}
+
+func changed(last, info os.FileInfo) bool {
+	if last == nil || info == nil {
+		return last != info
+	}
+	return !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()
+}
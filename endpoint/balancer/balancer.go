@@ -2,8 +2,11 @@ package balancer
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
@@ -11,17 +14,112 @@ const (
 	NoProxy Proxy = ""
 
 	RoundRobin = "round_robin"
+
+	LatencyEWMA = "latency_ewma"
+
+	LeastConn = "least_conn"
+
+	ConsistentHash = "consistent_hash"
 )
 
 type Proxy = peer.ID
 
 type Getter interface {
 	GetProxies(protocol protocol.Protocol) []Proxy
+
+	// Host returns the libp2p host used to reach the proxies,
+	// balancers may use it to probe them.
+	Host() host.Host
+
+	// Tracker returns the in-flight relays accounting of the proxies.
+	Tracker() *Tracker
+}
+
+// Request describes the local connection a proxy is picked for.
+type Request struct {
+	Protocol protocol.Protocol
+
+	// Source is the address of the local client, nil if unknown.
+	Source net.Addr
+
+	// Destination is the target host:port, empty unless the listener knows it.
+	Destination string
+
+	// TraceID identifies the connection in the logs of the endpoint and the proxy.
+	TraceID string
+
+	// Hints the client gave in its username.
+	Hints protocol.Hints
+}
+
+// Key returns a key identifying the request for sticky balancing, the session hint
+// if given, the destination host when it is known, otherwise the client source IP,
+// or the trace id of requests without a client.
+func (r *Request) Key() string {
+	if len(r.Hints.Session) > 0 {
+		return "session:" + r.Hints.Session
+	}
+	if len(r.Destination) > 0 {
+		if host, _, err := net.SplitHostPort(r.Destination); err == nil {
+			return host
+		}
+		return r.Destination
+	}
+	if r.Source == nil {
+		return r.TraceID
+	}
+	if host, _, err := net.SplitHostPort(r.Source.String()); err == nil {
+		return host
+	}
+	return r.Source.String()
 }
 
 type Balancer interface {
 	Name() string
-	Next(protocol protocol.Protocol) (Proxy, error)
+	Next(req *Request) (Proxy, error)
+}
+
+// Ranker is optionally implemented by a Balancer which can pick
+// several distinct proxies at once, in preference order.
+type Ranker interface {
+	Rank(req *Request, n int) ([]Proxy, error)
+}
+
+// Candidates returns up to n distinct proxies for req in preference order. Balancers
+// which are not a Ranker are asked for the next proxy until n distinct ones are picked.
+func Candidates(b Balancer, req *Request, n int) ([]Proxy, error) {
+	if r, ok := b.(Ranker); ok {
+		return r.Rank(req, n)
+	}
+	proxies := make([]Proxy, 0, n)
+	seen := make(map[Proxy]struct{}, n)
+	// a balancer may keep returning the same proxy, so do not ask forever
+	for i := 0; i < 2*n && len(proxies) < n; i++ {
+		proxy, err := b.Next(req)
+		if err != nil {
+			if len(proxies) > 0 {
+				break
+			}
+			return nil, err
+		}
+		if _, ok := seen[proxy]; !ok {
+			seen[proxy] = struct{}{}
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies, nil
+}
+
+// Keyed is optionally implemented by a Balancer picking proxies by the request key,
+// whose requests must not take idle pooled streams, opened to proxies of other keys.
+type Keyed interface {
+	Keyed()
+}
+
+// Feedback is optionally implemented by a Balancer which wants to be told
+// that opening a stream to the proxy it picked failed.
+type Feedback interface {
+	StreamFailed(proxy Proxy, err error)
 }
 
 type BalancerFactory func(getter Getter) (Balancer, error)
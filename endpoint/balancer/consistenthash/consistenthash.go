@@ -0,0 +1,152 @@
+package consistenthash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/protocol"
+)
+
+// virtual nodes per proxy, smooths out the share of keys each proxy gets
+const replicas = 64
+
+func init() {
+	err := balancer.RegisterBalancerFactory(balancer.ConsistentHash, New)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func New(getter balancer.Getter) (balancer.Balancer, error) {
+	return &consistentHash{Getter: getter}, nil
+}
+
+type consistentHash struct {
+	balancer.Getter
+
+	mu sync.Mutex
+	// ring of the proxy set of each protocol, rebuilt only when the set changes
+	rings map[protocol.Protocol]cachedRing
+}
+
+// cachedRing is the ring of a proxy slice of a registry snapshot, which is never modified,
+// so the ring is valid as long as the registry hands out the same slice.
+type cachedRing struct {
+	proxies []balancer.Proxy
+
+	ring *Ring
+}
+
+func (ch *consistentHash) Name() string {
+	return balancer.ConsistentHash
+}
+
+// Keyed implements balancer.Keyed, requests go to the owner of their key.
+func (ch *consistentHash) Keyed() {}
+
+func (ch *consistentHash) Next(req *balancer.Request) (balancer.Proxy, error) {
+	ranked, err := ch.Rank(req, 1)
+	if err != nil {
+		return balancer.NoProxy, err
+	}
+	return ranked[0], nil
+}
+
+// Rank returns the owner of the request key followed by the next proxies clockwise,
+// which are the ones the key moves to when its owner leaves.
+func (ch *consistentHash) Rank(req *balancer.Request, n int) ([]balancer.Proxy, error) {
+	proxies := ch.GetProxies(req.Protocol)
+	if len(proxies) == 0 {
+		return nil, balancer.NewNotEnoughProxiesError(req.Protocol)
+	}
+	return ch.ringOf(req.Protocol, proxies).GetN(req.Key(), n), nil
+}
+
+// ringOf returns the ring of the non empty proxies of protocol p. Once the registry hands
+// out another snapshot, the ring of the same proxy set is reused, of any protocol.
+func (ch *consistentHash) ringOf(p protocol.Protocol, proxies []balancer.Proxy) *Ring {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if c, ok := ch.rings[p]; ok && len(c.proxies) == len(proxies) && &c.proxies[0] == &proxies[0] {
+		return c.ring
+	}
+	if ch.rings == nil {
+		ch.rings = make(map[protocol.Protocol]cachedRing)
+	}
+	id := ringID(proxies)
+	var ring *Ring
+	for _, c := range ch.rings {
+		if c.ring.id == id {
+			ring = c.ring
+			break
+		}
+	}
+	if ring == nil {
+		ring = newRing(id, proxies)
+	}
+	ch.rings[p] = cachedRing{proxies: proxies, ring: ring}
+	return ring
+}
+
+// Ring is an immutable consistent hash ring of proxies.
+type Ring struct {
+	// sorted proxies joined, identifies the proxy set
+	id string
+
+	hashes  []uint32
+	proxies map[uint32]balancer.Proxy
+}
+
+func NewRing(proxies []balancer.Proxy) *Ring {
+	return newRing(ringID(proxies), proxies)
+}
+
+func newRing(id string, proxies []balancer.Proxy) *Ring {
+	r := &Ring{
+		id:      id,
+		hashes:  make([]uint32, 0, len(proxies)*replicas),
+		proxies: make(map[uint32]balancer.Proxy, len(proxies)*replicas),
+	}
+	for _, proxy := range proxies {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + string(proxy)))
+			r.hashes = append(r.hashes, h)
+			r.proxies[h] = proxy
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// GetN returns up to n distinct proxies found walking the ring clockwise from key.
+func (r *Ring) GetN(key string, n int) []balancer.Proxy {
+	if len(r.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	proxies := make([]balancer.Proxy, 0, n)
+	seen := make(map[balancer.Proxy]struct{}, n)
+	for i := 0; i < len(r.hashes) && len(proxies) < n; i++ {
+		proxy := r.proxies[r.hashes[(start+i)%len(r.hashes)]]
+		if _, ok := seen[proxy]; !ok {
+			seen[proxy] = struct{}{}
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+func ringID(proxies []balancer.Proxy) string {
+	ids := make([]string, len(proxies))
+	for i, proxy := range proxies {
+		ids[i] = string(proxy)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
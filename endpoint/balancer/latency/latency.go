@@ -0,0 +1,281 @@
+package latency
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/log"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	pingInterval = 30 * time.Second
+
+	pingTimeout = 10 * time.Second
+
+	// weight of the newest RTT sample in the moving average
+	alpha = 0.3
+
+	// proxies scoring within this ratio of the fastest one are picked at random,
+	// so that all endpoints do not herd onto the same proxy
+	tolerance = 0.2
+
+	// recent failures are halved on every probe round
+	failureDecay = 0.5
+)
+
+func init() {
+	err := balancer.RegisterBalancerFactory(balancer.LatencyEWMA, New)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func New(getter balancer.Getter) (balancer.Balancer, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &latencyEWMA{
+		Getter:    getter,
+		logger:    log.NewSubLogger("balancer/latency"),
+		stats:     make(map[balancer.Proxy]*stats),
+		protocols: make(map[protocol.Protocol]struct{}),
+		trigger:   make(chan struct{}, 1),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		cancel:    cancel,
+	}
+	go b.probe(ctx)
+	return b, nil
+}
+
+type stats struct {
+	// EWMA of the ping RTT, zero if never measured
+	rtt time.Duration
+	// decayed count of recent ping and stream failures
+	failures float64
+	// false once the last ping failed
+	healthy bool
+}
+
+func (s *stats) score() float64 {
+	return float64(s.rtt) * (1 + s.failures)
+}
+
+type latencyEWMA struct {
+	balancer.Getter
+
+	logger log.Logger
+
+	mu        sync.Mutex
+	stats     map[balancer.Proxy]*stats
+	protocols map[protocol.Protocol]struct{}
+	rand      *rand.Rand
+
+	trigger chan struct{}
+
+	cancel context.CancelFunc
+}
+
+func (b *latencyEWMA) Name() string {
+	return balancer.LatencyEWMA
+}
+
+func (b *latencyEWMA) Next(req *balancer.Request) (balancer.Proxy, error) {
+	ranked, err := b.Rank(req, 1)
+	if err != nil {
+		return balancer.NoProxy, err
+	}
+	return ranked[0], nil
+}
+
+// proxy classes, ranked in this order
+const (
+	measured = iota
+	unmeasured
+	unhealthy
+)
+
+func (b *latencyEWMA) Rank(req *balancer.Request, n int) ([]balancer.Proxy, error) {
+	p := req.Protocol
+	proxies := b.GetProxies(p)
+	if len(proxies) == 0 {
+		return nil, balancer.NewNotEnoughProxiesError(p)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.protocols[p]; !ok {
+		b.protocols[p] = struct{}{}
+		b.probeNow()
+	}
+
+	class := make(map[balancer.Proxy]int, len(proxies))
+	score := make(map[balancer.Proxy]float64, len(proxies))
+	for _, proxy := range proxies {
+		s, ok := b.stats[proxy]
+		switch {
+		case !ok:
+			class[proxy] = unmeasured
+			b.probeNow()
+		case !s.healthy:
+			class[proxy] = unhealthy
+		case s.rtt == 0:
+			class[proxy] = unmeasured
+		default:
+			class[proxy] = measured
+			score[proxy] = s.score()
+		}
+	}
+
+	ranked := append([]balancer.Proxy(nil), proxies...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if class[ranked[i]] != class[ranked[j]] {
+			return class[ranked[i]] < class[ranked[j]]
+		}
+		return score[ranked[i]] < score[ranked[j]]
+	})
+
+	// the first one is picked at random among those close to the best,
+	// if every proxy looks unhealthy, better to try one than to give up
+	first, best := ranked[0], score[ranked[0]]
+	candidates := 1
+	for ; candidates < len(ranked); candidates++ {
+		proxy := ranked[candidates]
+		if class[proxy] != class[first] || score[proxy] > best*(1+tolerance) {
+			break
+		}
+	}
+	i := b.rand.Intn(candidates)
+	ranked[0], ranked[i] = ranked[i], ranked[0]
+
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked, nil
+}
+
+func (b *latencyEWMA) StreamFailed(proxy balancer.Proxy, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.statsOf(proxy).failures++
+}
+
+func (b *latencyEWMA) Close() error {
+	b.cancel()
+	return nil
+}
+
+// probeNow wakes up the probe loop, must be called with b.mu held.
+func (b *latencyEWMA) probeNow() {
+	select {
+	case b.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// statsOf must be called with b.mu held.
+func (b *latencyEWMA) statsOf(proxy balancer.Proxy) *stats {
+	s, ok := b.stats[proxy]
+	if !ok {
+		s = &stats{healthy: true}
+		b.stats[proxy] = s
+	}
+	return s
+}
+
+func (b *latencyEWMA) probe(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.trigger:
+		case <-ctx.Done():
+			return
+		}
+		b.pingAll(ctx)
+	}
+}
+
+func (b *latencyEWMA) pingAll(ctx context.Context) {
+	proxies := b.known()
+
+	var wg sync.WaitGroup
+	for _, proxy := range proxies {
+		wg.Add(1)
+		go func(proxy balancer.Proxy) {
+			defer wg.Done()
+			rtt, err := b.ping(ctx, proxy)
+			if ctx.Err() != nil {
+				return
+			}
+			b.record(proxy, rtt, err)
+		}(proxy)
+	}
+	wg.Wait()
+}
+
+func (b *latencyEWMA) ping(ctx context.Context, proxy balancer.Proxy) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	res, ok := <-ping.Ping(ctx, b.Host(), proxy)
+	if !ok {
+		return 0, ctx.Err()
+	}
+	return res.RTT, res.Error
+}
+
+func (b *latencyEWMA) record(proxy balancer.Proxy, rtt time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.statsOf(proxy)
+	s.failures *= failureDecay
+	if err != nil {
+		b.logger.Debugf("Ping proxy [%s] failed: %s", proxy, err)
+		s.healthy = false
+		s.failures++
+		return
+	}
+	s.healthy = true
+	if s.rtt == 0 {
+		s.rtt = rtt
+	} else {
+		s.rtt = time.Duration(alpha*float64(rtt) + (1-alpha)*float64(s.rtt))
+	}
+}
+
+// known returns proxies of every protocol asked for so far,
+// and forgets the stats of those no longer offered by the getter.
+func (b *latencyEWMA) known() []balancer.Proxy {
+	b.mu.Lock()
+	protocols := make([]protocol.Protocol, 0, len(b.protocols))
+	for p := range b.protocols {
+		protocols = append(protocols, p)
+	}
+	b.mu.Unlock()
+
+	set := make(map[balancer.Proxy]struct{})
+	for _, p := range protocols {
+		for _, proxy := range b.GetProxies(p) {
+			set[proxy] = struct{}{}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for proxy := range b.stats {
+		if _, ok := set[proxy]; !ok {
+			delete(b.stats, proxy)
+		}
+	}
+	proxies := make([]balancer.Proxy, 0, len(set))
+	for proxy := range set {
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
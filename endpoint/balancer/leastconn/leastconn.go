@@ -0,0 +1,60 @@
+package leastconn
+
+import (
+	"sort"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+
+	"go.uber.org/atomic"
+)
+
+func init() {
+	err := balancer.RegisterBalancerFactory(balancer.LeastConn, New)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func New(getter balancer.Getter) (balancer.Balancer, error) {
+	return &leastConn{Getter: getter}, nil
+}
+
+type leastConn struct {
+	balancer.Getter
+	// rotates the starting point, so ties do not always go to the same proxy
+	counter atomic.Uint32
+}
+
+func (lc *leastConn) Name() string {
+	return balancer.LeastConn
+}
+
+func (lc *leastConn) Next(req *balancer.Request) (balancer.Proxy, error) {
+	ranked, err := lc.Rank(req, 1)
+	if err != nil {
+		return balancer.NoProxy, err
+	}
+	return ranked[0], nil
+}
+
+func (lc *leastConn) Rank(req *balancer.Request, n int) ([]balancer.Proxy, error) {
+	proxies := lc.GetProxies(req.Protocol)
+	if len(proxies) == 0 {
+		return nil, balancer.NewNotEnoughProxiesError(req.Protocol)
+	}
+	tracker := lc.Tracker()
+	start := int(lc.counter.Inc() % uint32(len(proxies)))
+
+	ranked := make([]balancer.Proxy, len(proxies))
+	active := make(map[balancer.Proxy]int, len(proxies))
+	for i := range proxies {
+		proxy := proxies[(start+i)%len(proxies)]
+		ranked[i] = proxy
+		active[proxy] = tracker.Active(proxy)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return active[ranked[i]] < active[ranked[j]] })
+	if n < len(ranked) {
+		ranked = ranked[:n]
+	}
+	return ranked, nil
+}
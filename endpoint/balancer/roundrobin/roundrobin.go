@@ -2,7 +2,6 @@ package roundrobin
 
 import (
 	"github.com/diandianl/p2p-proxy/endpoint/balancer"
-	"github.com/diandianl/p2p-proxy/protocol"
 
 	"go.uber.org/atomic"
 )
@@ -27,10 +26,27 @@ func (rr *roundrobin) Name() string {
 	return balancer.RoundRobin
 }
 
-func (rr *roundrobin) Next(p protocol.Protocol) (balancer.Proxy, error) {
+func (rr *roundrobin) Next(req *balancer.Request) (balancer.Proxy, error) {
+	p := req.Protocol
 	proxies := rr.GetProxies(p)
 	if len(proxies) == 0 {
 		return balancer.NoProxy, balancer.NewNotEnoughProxiesError(p)
 	}
 	return proxies[rr.counter.Inc()%uint32(len(proxies))], nil
 }
+
+func (rr *roundrobin) Rank(req *balancer.Request, n int) ([]balancer.Proxy, error) {
+	proxies := rr.GetProxies(req.Protocol)
+	if len(proxies) == 0 {
+		return nil, balancer.NewNotEnoughProxiesError(req.Protocol)
+	}
+	if n > len(proxies) {
+		n = len(proxies)
+	}
+	start := rr.counter.Inc()
+	ranked := make([]balancer.Proxy, n)
+	for i := range ranked {
+		ranked[i] = proxies[(start+uint32(i))%uint32(len(proxies))]
+	}
+	return ranked, nil
+}
@@ -0,0 +1,39 @@
+package balancer
+
+import "sync"
+
+// Tracker accounts the in-flight relays of every proxy,
+// it is safe for concurrent use.
+type Tracker struct {
+	mu     sync.RWMutex
+	active map[Proxy]int
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{active: make(map[Proxy]int)}
+}
+
+// Opened records a relay started through proxy.
+func (t *Tracker) Opened(proxy Proxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active[proxy]++
+}
+
+// Closed records a relay through proxy finished.
+func (t *Tracker) Closed(proxy Proxy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[proxy] <= 1 {
+		delete(t.active, proxy)
+		return
+	}
+	t.active[proxy]--
+}
+
+// Active returns the number of in-flight relays through proxy.
+func (t *Tracker) Active(proxy Proxy) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.active[proxy]
+}
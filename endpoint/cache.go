@@ -0,0 +1,211 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/endpoint/registry"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// interval of saving the known proxies to 'Endpoint.ProxyCache'
+const cacheSaveInterval = 5 * time.Minute
+
+type cachedProxy struct {
+	ID string `json:"id"`
+
+	// proxy pool of the proxy, empty for the default one
+	Pool string `json:"pool,omitempty"`
+
+	Addrs []string `json:"addrs"`
+
+	Protocols []protocol.Protocol `json:"protocols"`
+
+	LastSeen time.Time `json:"lastSeen"`
+
+	// latency EWMA recorded in the peerstore
+	RTT time.Duration `json:"rtt"`
+
+	Failures int `json:"failures"`
+}
+
+func (e *endpoint) proxyCachePath() (string, error) {
+	if len(e.cfg.Endpoint.ProxyCache) == 0 {
+		return "", nil
+	}
+	return e.cfg.ResolvePath(e.cfg.Endpoint.ProxyCache)
+}
+
+// loadProxyCache seeds the peerstore and registry with the proxies of the pool
+// saved by an earlier run, and returns them to be refreshed.
+func (pp *proxyPool) loadProxyCache() ([]peer.AddrInfo, error) {
+	file, err := pp.proxyCachePath()
+	if err != nil || len(file) == 0 {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cached []cachedProxy
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, err
+	}
+
+	ttl := pp.settings.Health.TTL
+	if ttl <= 0 {
+		ttl = registry.DefaultOptions.TTL
+	}
+	ps := pp.node.Peerstore()
+
+	var loaded []peer.AddrInfo
+	for _, c := range cached {
+		if cachedPool(c.Pool) != pp.settings.Name || time.Since(c.LastSeen) > ttl {
+			continue
+		}
+		id, err := peer.Decode(c.ID)
+		if err != nil {
+			pp.logger.Debugf("Skip cached proxy [%s]: %s", c.ID, err)
+			continue
+		}
+		if !pp.admits(id) {
+			continue
+		}
+		addrs := make([]maddr.Multiaddr, 0, len(c.Addrs))
+		for _, a := range c.Addrs {
+			if ma, err := maddr.NewMultiaddr(a); err == nil {
+				addrs = append(addrs, ma)
+			}
+		}
+		ps.AddAddrs(id, addrs, peerstore.AddressTTL)
+		if c.RTT > 0 {
+			ps.RecordLatency(id, c.RTT)
+		}
+		pp.registry.Restore(registry.Entry{
+			ID:        id,
+			LastSeen:  c.LastSeen,
+			Failures:  c.Failures,
+			Protocols: c.Protocols,
+		})
+		loaded = append(loaded, peer.AddrInfo{ID: id, Addrs: addrs})
+	}
+	pp.logger.Infof("Loaded %d proxies of pool [%s] from cache %s", len(loaded), pp.settings.Name, file)
+	return loaded, nil
+}
+
+// refreshCachedProxies re-dials the cached proxies, refreshing the protocols of
+// those reachable and penalizing the others.
+func (pp *proxyPool) refreshCachedProxies(ctx context.Context, proxies []peer.AddrInfo) {
+	var wg sync.WaitGroup
+	for _, addr := range proxies {
+		wg.Add(1)
+		go func(addr peer.AddrInfo) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			if err := pp.node.Connect(ctx, addr); err != nil {
+				pp.logger.Debugf("Connect to cached proxy [%s]: %s", addr.ID, err)
+				pp.registry.Failed(addr.ID)
+				return
+			}
+			pp.registry.SetProtocols(addr.ID, pp.supportedProtocols(addr.ID))
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// saveProxyCache saves the usable proxies of the registries of the pools
+// with discovery enabled, static proxies excluded.
+func (e *endpoint) saveProxyCache() error {
+	file, err := e.proxyCachePath()
+	if err != nil || len(file) == 0 {
+		return err
+	}
+	ps := e.node.Peerstore()
+
+	var (
+		cached     []cachedProxy
+		discovered bool
+	)
+	for _, pp := range e.pools {
+		if !pp.discoveryEnabled() {
+			continue
+		}
+		discovered = true
+		for _, entry := range pp.registry.Snapshot().Entries() {
+			if entry.Static || entry.State == registry.Evicted || len(entry.Protocols) == 0 {
+				continue
+			}
+			addrs := ps.Addrs(entry.ID)
+			if len(addrs) == 0 {
+				continue
+			}
+			c := cachedProxy{
+				ID:        peer.Encode(entry.ID),
+				Protocols: entry.Protocols,
+				LastSeen:  entry.LastSeen,
+				RTT:       ps.LatencyEWMA(entry.ID),
+				Failures:  entry.Failures,
+			}
+			if pp.settings.Name != config.DefaultPool {
+				c.Pool = pp.settings.Name
+			}
+			for _, addr := range addrs {
+				c.Addrs = append(c.Addrs, addr.String())
+			}
+			cached = append(cached, c)
+		}
+	}
+	if !discovered {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// cachedPool returns the pool name of a cached proxy, which omits the default one.
+func cachedPool(name string) string {
+	if len(name) == 0 {
+		return config.DefaultPool
+	}
+	return name
+}
+
+func (e *endpoint) syncProxyCache(ctx context.Context) {
+	ticker := time.NewTicker(cacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.saveProxyCache(); err != nil {
+				e.logger.Warn("Save proxy cache ", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
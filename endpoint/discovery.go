@@ -0,0 +1,136 @@
+package endpoint
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+const (
+	// timeout of connecting a discovered proxy to learn its protocols
+	probeTimeout = 30 * time.Second
+
+	// default of 'Endpoint.ProxyWaitTimeout'
+	defaultProxyWaitTimeout = 30 * time.Second
+)
+
+// syncProxies runs discovery rounds every 'Endpoint.ServiceDiscoveryInterval',
+// or earlier when woken up by a connection waiting for proxies.
+func (pp *proxyPool) syncProxies(ctx context.Context) {
+	ticker := time.NewTicker(pp.cfg.Endpoint.ServiceDiscoveryInterval)
+	defer ticker.Stop()
+	for {
+		pp.discoverProxies(ctx)
+		select {
+		case <-ticker.C:
+		case <-pp.discoverNow:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// discoverProxies queries the service tag and the rendezvous of every listener
+// protocol at once, and feeds proxies into the registry as they are found.
+func (pp *proxyPool) discoverProxies(ctx context.Context) {
+	namespaces := []string{pp.settings.ServiceTag}
+	for _, p := range pp.listenerProtocols() {
+		namespaces = append(namespaces, protocol.Rendezvous(pp.settings.ServiceTag, p))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		probing = make(map[peer.ID]struct{})
+	)
+	for _, ns := range namespaces {
+		addrs, err := pp.discoverer.FindPeers(ctx, ns)
+		if err != nil {
+			pp.logger.Warnf("Find proxies of [%s]: %s", ns, err)
+			continue
+		}
+		wg.Add(1)
+		go func(ns string, addrs <-chan peer.AddrInfo) {
+			defer wg.Done()
+			for addr := range addrs {
+				if addr.ID == pp.node.ID() {
+					continue
+				}
+				mu.Lock()
+				_, ok := probing[addr.ID]
+				probing[addr.ID] = struct{}{}
+				mu.Unlock()
+				if ok {
+					continue
+				}
+				wg.Add(1)
+				go func(addr peer.AddrInfo) {
+					defer wg.Done()
+					pp.probeProxy(ctx, addr)
+				}(addr)
+			}
+		}(ns, addrs)
+	}
+	wg.Wait()
+}
+
+// probeProxy registers a discovered proxy, connecting first if its protocols are not
+// known yet, which waits for identify to fill the peerstore with them.
+func (pp *proxyPool) probeProxy(ctx context.Context, addr peer.AddrInfo) {
+	if !pp.admits(addr.ID) {
+		return
+	}
+	if entry, ok := pp.registry.Snapshot().Get(addr.ID); ok && len(entry.Protocols) > 0 {
+		pp.registry.Seen(addr.ID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if err := pp.node.Connect(ctx, addr); err != nil {
+		pp.logger.Debugf("Connect to discovered proxy [%s]: %s", addr.ID, err)
+		return
+	}
+	protocols := pp.supportedProtocols(addr.ID)
+	if len(protocols) == 0 {
+		pp.logger.Debugf("Discovered proxy [%s] serves none of the listener protocols", addr.ID)
+		return
+	}
+	pp.registry.Seen(addr.ID)
+	pp.registry.SetProtocols(addr.ID, protocols)
+}
+
+// waitProxies blocks until any proxy serves protocol p or 'Endpoint.ProxyWaitTimeout' elapsed,
+// waking up discovery if it is enabled.
+func (pp *proxyPool) waitProxies(ctx context.Context, p protocol.Protocol) error {
+	if pp.discoveryEnabled() {
+		select {
+		case pp.discoverNow <- struct{}{}:
+		default:
+		}
+	}
+	timeout := pp.cfg.Endpoint.ProxyWaitTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyWaitTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// take the snapshot before checking, so no change is missed
+		snapshot := pp.registry.Snapshot()
+		if len(pp.GetProxies(p)) > 0 {
+			return nil
+		}
+		select {
+		case <-snapshot.Changed():
+		case <-timer.C:
+			return balancer.NewNotEnoughProxiesError(p)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -3,26 +3,29 @@ package endpoint
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
-	"sync"
 	"time"
 
 	"github.com/diandianl/p2p-proxy/config"
 	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/endpoint/retry"
+	"github.com/diandianl/p2p-proxy/endpoint/rule"
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/p2p"
 	"github.com/diandianl/p2p-proxy/protocol"
-	"github.com/diandianl/p2p-proxy/relay"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
 
 	"github.com/libp2p/go-libp2p-core/discovery"
 	"github.com/libp2p/go-libp2p-core/host"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
-	p2pproto "github.com/libp2p/go-libp2p-core/protocol"
-	discovery2 "github.com/libp2p/go-libp2p-discovery"
 	"go.uber.org/multierr"
 )
 
+// interval of dropping expired proxies and re-admitting evicted ones
+const maintainInterval = 10 * time.Second
+
 type Endpoint interface {
 	Start(ctx context.Context) error
 
@@ -33,12 +36,27 @@ func New(cfg *config.Config) (Endpoint, error) {
 	if err := cfg.Validate(false); err != nil {
 		return nil, err
 	}
-	return &endpoint{
+	e := &endpoint{
 		logger:   log.NewSubLogger("endpoint"),
 		cfg:      cfg,
-		proxies:  make(map[peer.ID]struct{}),
+		tracker:  balancer.NewTracker(),
+		retry:    retry.FromConfig(cfg.Endpoint.Retry),
+		pools:    make(map[string]*proxyPool),
 		stopping: make(chan struct{}),
-	}, nil
+	}
+	for _, settings := range cfg.ProxyPools() {
+		pp, err := newProxyPool(e, settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy pool [%s]: %s", settings.Name, err)
+		}
+		e.pools[settings.Name] = pp
+	}
+	rules, err := rule.Load(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'Endpoint.Routing': %s", err)
+	}
+	e.rules = rule.NewEngine(rules)
+	return e, nil
 }
 
 type endpoint struct {
@@ -52,10 +70,15 @@ type endpoint struct {
 
 	listeners []protocol.Listener
 
-	balancer balancer.Balancer
+	// in-flight relays of the proxies of all pools
+	tracker *balancer.Tracker
+
+	retry retry.Policy
 
-	sync.Mutex
-	proxies map[peer.ID]struct{}
+	rules *rule.Engine
+
+	// proxy pools by name, the default one included
+	pools map[string]*proxyPool
 
 	stopping chan struct{}
 }
@@ -73,30 +96,42 @@ func (e *endpoint) Start(ctx context.Context) (err error) {
 		return errors.New("'Config.Endpoint.ProxyProtocols' can not be empty")
 	}
 
-	e.balancer, err = balancer.New(c.Endpoint.Balancer, e)
+	e.node, e.discoverer, err = p2p.NewHostAndDiscovererAndBootstrap(ctx, c)
 	if err != nil {
 		return err
 	}
 
-	logger.Debugf("Endpoint using '%s' balancer", e.balancer.Name())
-
-	e.node, e.discoverer, err = p2p.NewHostAndDiscovererAndBootstrap(ctx, c)
-	if err != nil {
-		return err
+	for _, pp := range e.pools {
+		if err := pp.start(ctx); err != nil {
+			return fmt.Errorf("start proxy pool [%s]: %s", pp.settings.Name, err)
+		}
 	}
+	go e.syncProxyCache(ctx)
+	e.watchRules(ctx)
 
-	go e.syncProxies(ctx)
+	if len(c.Endpoint.PAC.Listen) > 0 {
+		go func() {
+			if err := e.servePAC(ctx); err != nil {
+				e.logger.Error("Serve PAC file ", err)
+			}
+		}()
+	}
 
 	for _, p := range c.Endpoint.ProxyProtocols {
-		lsr, err := protocol.NewListener(protocol.Protocol(p.Protocol), p.Listen)
+		lsrCfg, err := e.listenerConfig(p.Config)
 		if err != nil {
 			return err
 		}
-		logger.Infof("Enable %s service, listen at: %s", lsr.Protocol(), p.Listen)
+		lsr, err := protocol.NewListener(protocol.Protocol(p.Protocol), p.Listen, lsrCfg)
+		if err != nil {
+			return err
+		}
+		pp := e.pools[listenerPool(p)]
+		logger.Infof("Enable %s service, listen at: %s, proxy pool: %s", lsr.Protocol(), p.Listen, pp.settings.Name)
 		e.listeners = append(e.listeners, lsr)
 
 		go func() {
-			err := e.startListener(ctx, lsr)
+			err := e.startListener(ctx, lsr, pp)
 			if err != nil {
 				e.logger.Errorf("start proxy listener [%s], ", lsr.Protocol(), err)
 			}
@@ -107,26 +142,66 @@ func (e *endpoint) Start(ctx context.Context) (err error) {
 	return e.Stop()
 }
 
-func (e *endpoint) startListener(ctx context.Context, lsr protocol.Listener) error {
+// startListener serves the connections of lsr, which go out via the proxy pool pp
+// unless routing rules or client hints pick another one.
+func (e *endpoint) startListener(ctx context.Context, lsr protocol.Listener, pp *proxyPool) error {
 	for {
 		conn, err := lsr.Accept()
 		if err != nil {
 			return e.errorTriggeredByStop(err)
 		}
-		go e.connHandler(ctx, lsr.Protocol(), conn)
+		go e.connHandler(ctx, lsr.Protocol(), pp, conn)
 	}
 }
 
-func (e *endpoint) connHandler(ctx context.Context, p protocol.Protocol, conn net.Conn) {
-	stream, err := e.newProxyStream(ctx, p, 3)
+func (e *endpoint) connHandler(ctx context.Context, p protocol.Protocol, pp *proxyPool, conn net.Conn) {
+	req := &balancer.Request{Protocol: p, Source: conn.RemoteAddr(), TraceID: newTraceID()}
+	pc, terminated := conn.(protocol.Conn)
+	var poolName string
+	if terminated {
+		req.Protocol, req.Destination, req.Hints = pc.Protocol(), pc.Target(), pc.Hints()
+		if len(req.Destination) > 0 {
+			decision, handled := e.route(ctx, pc)
+			if handled {
+				return
+			}
+			poolName = decision.Pool
+		}
+		if len(req.Hints.Pool) > 0 {
+			poolName = req.Hints.Pool
+		}
+	}
+	var stream network.Stream
+	pp, err := e.selectPool(pp, poolName)
+	if err == nil {
+		if req.Protocol == protocol.Connect {
+			stream, err = pp.newConnectStream(ctx, req)
+		} else {
+			stream, err = pp.newProxyStream(ctx, req)
+		}
+	}
 	// If an error happens, we write an error for response.
 	if err != nil {
 		if e.errorTriggeredByStop(err) != nil {
-			e.logger.Warn("New stream ", err)
+			e.logger.Warnf("New stream, trace %s: %s", req.TraceID, err)
+		}
+		if terminated {
+			// raw connections are answered in their client protocol
+			pc, _ = terminate(pc)
+			pc.Reply(err)
 		}
+		conn.Close()
 		return
 	}
-	if err := relay.CloseAfterRelay(conn, stream); e.errorTriggeredByStop(err) != nil {
+	if terminated {
+		if err := pc.Reply(nil); err != nil {
+			e.logger.Debugf("Reply to [%s]: %s", conn.RemoteAddr(), err)
+			stream.Reset()
+			conn.Close()
+			return
+		}
+	}
+	if err := pp.relay(ctx, req, conn, stream); e.errorTriggeredByStop(err) != nil {
 		e.logger.Warn("Relay failure: ", err)
 	}
 }
@@ -149,93 +224,93 @@ func (e *endpoint) errorTriggeredByStop(err error) error {
 	}
 }
 
-func (e *endpoint) newProxyStream(ctx context.Context, p protocol.Protocol, retry int) (network.Stream, error) {
-	proxy, err := e.balancer.Next(p)
-	if err != nil {
-		if balancer.IsNewNotEnoughProxiesError(err) && retry > 0 {
-			proxies, err := e.DiscoveryProxies(ctx)
-			if err != nil {
-				return nil, err
-			}
-			e.UpdateProxies(proxies)
-			return e.newProxyStream(ctx, p, 0)
-		}
-		return nil, err
+// selectPool returns the proxy pool named name, pp if name is empty.
+func (e *endpoint) selectPool(pp *proxyPool, name string) (*proxyPool, error) {
+	if len(name) == 0 {
+		return pp, nil
 	}
-	s, err := e.node.NewStream(ctx, proxy, p2pproto.ID(p))
-	if err != nil {
-		e.DeleteProxy(proxy)
-		retry--
-		if retry <= 0 {
-			return nil, err
-		}
-		return e.newProxyStream(ctx, p, retry)
+	if named, ok := e.pools[name]; ok {
+		return named, nil
 	}
-	return s, nil
+	return nil, fmt.Errorf("unknown proxy pool [%s]", name)
 }
 
-func (e *endpoint) syncProxies(ctx context.Context) {
-	ticker := time.NewTicker(e.cfg.Endpoint.ServiceDiscoveryInterval)
-	for {
-		if proxies, err := e.DiscoveryProxies(ctx); err != nil {
-			e.logger.Error(err)
-		} else {
-			e.UpdateProxies(proxies)
-		}
-		select {
-		case <-ticker.C:
-		case <-ctx.Done():
-			ticker.Stop()
-			return
+// listenerPool returns the name of the proxy pool of listener p.
+func listenerPool(p config.ProxyProtocol) string {
+	if len(p.Pool) == 0 {
+		return config.DefaultPool
+	}
+	return p.Pool
+}
+
+// listenerProtocols returns the protocols the listeners relay connections with.
+func (e *endpoint) listenerProtocols() []protocol.Protocol {
+	protocols := make([]protocol.Protocol, 0, len(e.cfg.Endpoint.ProxyProtocols))
+	seen := make(map[protocol.Protocol]struct{})
+	for _, p := range e.cfg.Endpoint.ProxyProtocols {
+		for _, remote := range protocol.RemoteProtocols(protocol.Protocol(p.Protocol)) {
+			if _, ok := seen[remote]; !ok {
+				seen[remote] = struct{}{}
+				protocols = append(protocols, remote)
+			}
 		}
 	}
+	return protocols
 }
 
-func (e *endpoint) UpdateProxies(proxies []peer.ID) {
-	e.Lock()
-	defer e.Unlock()
-	for _, p := range proxies {
-		e.proxies[p] = struct{}{}
+// listenerConfig returns a copy of the config of a listener, with the relative
+// 'HtpasswdFile' resolved against the config file directory.
+func (e *endpoint) listenerConfig(cfg map[string]interface{}) (map[string]interface{}, error) {
+	resolved := make(map[string]interface{}, len(cfg))
+	for k, v := range cfg {
+		resolved[k] = v
+	}
+	if file, ok := resolved[auth.ConfigHtpasswdFile].(string); ok && len(file) > 0 {
+		path, err := e.cfg.ResolvePath(file)
+		if err != nil {
+			return nil, err
+		}
+		resolved[auth.ConfigHtpasswdFile] = path
 	}
+	return resolved, nil
 }
 
-func (e *endpoint) GetProxies(p protocol.Protocol) []peer.ID {
-	if len(e.proxies) == 0 {
+// supportedProtocols returns the listener protocols the peerstore knows proxy supports.
+func (e *endpoint) supportedProtocols(proxy peer.ID) []protocol.Protocol {
+	var protos []string
+	for _, p := range e.listenerProtocols() {
+		protos = append(protos, string(p))
+	}
+	supported, err := e.node.Peerstore().SupportsProtocols(proxy, protos...)
+	if err != nil {
+		e.logger.Debugf("Get protocols of proxy [%s] from peerstore: %s", proxy, err)
 		return nil
 	}
-	e.Lock()
-	defer e.Unlock()
-	proxies := make([]peer.ID, 0, len(e.proxies))
-	for p, _ := range e.proxies {
-		proxies = append(proxies, p)
+	protocols := make([]protocol.Protocol, 0, len(supported))
+	for _, p := range supported {
+		protocols = append(protocols, protocol.Protocol(p))
 	}
-	return proxies
+	return protocols
 }
 
-func (e *endpoint) DeleteProxy(id peer.ID) {
-	e.Lock()
-	defer e.Unlock()
-	delete(e.proxies, id)
+func (e *endpoint) Host() host.Host {
+	return e.node
 }
 
-func (e *endpoint) DiscoveryProxies(ctx context.Context) ([]peer.ID, error) {
-	addrs, err := discovery2.FindPeers(ctx, e.discoverer, e.cfg.ServiceTag)
-	if err != nil {
-		return nil, err
-	}
-	proxies := make([]peer.ID, 0, len(addrs))
-	for _, addr := range addrs {
-		proxies = append(proxies, addr.ID)
-	}
-	return proxies, nil
+func (e *endpoint) Tracker() *balancer.Tracker {
+	return e.tracker
 }
 
 func (e *endpoint) Stop() error {
 	close(e.stopping)
-	errs := make([]error, 0, len(e.listeners)+1)
+	errs := make([]error, 0, len(e.listeners)+len(e.pools)+2)
 	for _, lsr := range e.listeners {
 		errs = append(errs, lsr.Close())
 	}
+	for _, pp := range e.pools {
+		errs = append(errs, pp.close())
+	}
+	errs = append(errs, e.saveProxyCache())
 	errs = append(errs, e.node.Close())
 	return multierr.Combine(errs...)
 }
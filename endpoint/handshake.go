@@ -0,0 +1,77 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	p2pproto "github.com/libp2p/go-libp2p-core/protocol"
+)
+
+func newTraceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (e *endpoint) handshakeRequest(req *balancer.Request) *handshake.Request {
+	return &handshake.Request{
+		TraceID:     req.TraceID,
+		Token:       e.cfg.Endpoint.Token,
+		Destination: req.Destination,
+	}
+}
+
+// handshake sends the request and waits for the response of the proxy.
+func (e *endpoint) handshake(ctx context.Context, s network.Stream, req *balancer.Request) error {
+	if err := handshake.WriteRequest(s, e.handshakeRequest(req)); err != nil {
+		return err
+	}
+	return awaitRead(ctx, s, func() error {
+		resp, err := handshake.ReadResponse(s)
+		if err != nil {
+			return err
+		}
+		return resp.Err()
+	})
+}
+
+// pipelineHandshake sends the request on a pooled stream without waiting for the
+// response, which is read before the first response byte instead, so a rejection
+// shows up as a read error and the connection is replayed on another proxy.
+func (e *endpoint) pipelineHandshake(s network.Stream, req *balancer.Request) (network.Stream, error) {
+	if s.Protocol() != p2pproto.ID(handshake.ID(req.Protocol)) {
+		return s, nil
+	}
+	if err := handshake.WriteRequest(s, e.handshakeRequest(req)); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return &pipelinedStream{Stream: s}, nil
+}
+
+type pipelinedStream struct {
+	network.Stream
+
+	once sync.Once
+
+	err error
+}
+
+func (s *pipelinedStream) Read(b []byte) (int, error) {
+	s.once.Do(func() {
+		var resp *handshake.Response
+		if resp, s.err = handshake.ReadResponse(s.Stream); s.err == nil {
+			s.err = resp.Err()
+		}
+	})
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.Stream.Read(b)
+}
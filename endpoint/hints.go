@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"fmt"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// hintedProxy returns the proxy the peer or alias hint of req pins it to,
+// NoProxy if it has neither. The proxy must serve the requested protocol.
+func (pp *proxyPool) hintedProxy(req *balancer.Request) (peer.ID, error) {
+	var proxy peer.ID
+	switch {
+	case len(req.Hints.Peer) > 0:
+		id, err := peer.IDB58Decode(req.Hints.Peer)
+		if err != nil {
+			return balancer.NoProxy, fmt.Errorf("invalid peer hint [%s]: %s", req.Hints.Peer, err)
+		}
+		proxy = id
+	case len(req.Hints.Alias) > 0:
+		for _, entry := range pp.registry.Snapshot().Entries() {
+			if entry.Alias == req.Hints.Alias {
+				proxy = entry.ID
+				break
+			}
+		}
+		if proxy == balancer.NoProxy {
+			return balancer.NoProxy, fmt.Errorf("unknown proxy alias [%s]", req.Hints.Alias)
+		}
+	default:
+		return balancer.NoProxy, nil
+	}
+	if !containsProxy(pp.GetProxies(req.Protocol), proxy) {
+		return balancer.NoProxy, fmt.Errorf("hinted proxy [%s] is not available for [%s]", proxy, req.Protocol)
+	}
+	return proxy, nil
+}
+
+// balancerOf returns the balancer picking the proxy of req.
+func (pp *proxyPool) balancerOf(req *balancer.Request) balancer.Balancer {
+	if len(req.Hints.Session) > 0 {
+		return pp.sessions
+	}
+	return pp.balancer
+}
+
+// picksProxy reports whether hints pick the proxy instead of the balancer.
+func picksProxy(hints protocol.Hints) bool {
+	return len(hints.Peer) > 0 || len(hints.Alias) > 0 || len(hints.Session) > 0
+}
@@ -0,0 +1,39 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/diandianl/p2p-proxy/export"
+)
+
+// servePAC serves the proxy auto-config file at /proxy.pac on 'Endpoint.PAC.Listen',
+// generated per request so reloaded rules show up.
+func (e *endpoint) servePAC(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		// listeners on unspecified addresses are reached at the host the PAC file was fetched from
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		pac, err := export.PAC(export.Listeners(e.cfg, host), e.rules.Set().DirectDomains())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write(pac)
+	})
+	srv := &http.Server{Addr: e.cfg.Endpoint.PAC.Listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	e.logger.Infof("Serving PAC file at http://%s/proxy.pac", e.cfg.Endpoint.PAC.Listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+const (
+	// timeout of opening a single idle stream
+	dialTimeout = 30 * time.Second
+
+	// delay before filling again after a failed dial, doubled up to maxRetryDelay
+	retryDelay = time.Second
+
+	maxRetryDelay = 30 * time.Second
+)
+
+// Dialer opens a stream to a proxy, negotiated so it is ready for relaying.
+type Dialer func(ctx context.Context) (network.Stream, error)
+
+type Options struct {
+	// idle streams kept ready, the pool is disabled if not positive
+	MinIdle int
+
+	// idle streams older than this are closed and replaced, never if zero
+	MaxAge time.Duration
+}
+
+// Pool keeps pre-negotiated idle streams of a protocol, so a new local
+// connection skips opening a stream, and refills in the background.
+type Pool struct {
+	dial Dialer
+
+	opts Options
+
+	mu sync.Mutex
+	// oldest first
+	idle []idleStream
+
+	closed bool
+
+	refill chan struct{}
+}
+
+type idleStream struct {
+	stream network.Stream
+
+	created time.Time
+}
+
+func New(dial Dialer, opts Options) *Pool {
+	return &Pool{dial: dial, opts: opts, refill: make(chan struct{}, 1)}
+}
+
+// Get takes the newest idle stream which is not expired and accepted by usable,
+// nil if there is none. Streams rejected on the way are closed.
+func (p *Pool) Get(usable func(network.Stream) bool) network.Stream {
+	defer p.wakeup()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.idle) > 0 {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !p.expired(last, time.Now()) && usable(last.stream) {
+			return last.stream
+		}
+		go helpers.FullClose(last.stream)
+	}
+	return nil
+}
+
+// Idle returns the number of idle streams.
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// Run keeps the pool filled until ctx is done or the pool is closed.
+func (p *Pool) Run(ctx context.Context) {
+	if p.opts.MinIdle <= 0 {
+		return
+	}
+	check := time.Minute
+	if p.opts.MaxAge > 0 && p.opts.MaxAge/2 < check {
+		check = p.opts.MaxAge / 2
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	delay := retryDelay
+	for !p.isClosed() {
+		p.expire(time.Now())
+		if p.fill(ctx) {
+			delay = retryDelay
+			select {
+			case <-ticker.C:
+			case <-p.refill:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		timer := time.NewTimer(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// fill opens the missing idle streams at once, and reports whether all of them succeeded.
+func (p *Pool) fill(ctx context.Context) bool {
+	p.mu.Lock()
+	missing := p.opts.MinIdle - len(p.idle)
+	p.mu.Unlock()
+	if missing <= 0 {
+		return true
+	}
+
+	var (
+		wg     sync.WaitGroup
+		failed bool
+	)
+	for i := 0; i < missing; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			s, err := p.dial(ctx)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if err != nil {
+				failed = true
+				return
+			}
+			if p.closed {
+				s.Reset()
+				return
+			}
+			p.idle = append(p.idle, idleStream{stream: s, created: time.Now()})
+		}()
+	}
+	wg.Wait()
+	return !failed
+}
+
+func (p *Pool) expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := 0
+	for ; i < len(p.idle) && p.expired(p.idle[i], now); i++ {
+		go helpers.FullClose(p.idle[i].stream)
+	}
+	p.idle = p.idle[i:]
+}
+
+func (p *Pool) expired(s idleStream, now time.Time) bool {
+	return p.opts.MaxAge > 0 && now.Sub(s.created) >= p.opts.MaxAge
+}
+
+func (p *Pool) wakeup() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Close resets the idle streams and stops filling.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+	p.wakeup()
+	for _, s := range idle {
+		s.stream.Reset()
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/endpoint/pool"
+	"github.com/diandianl/p2p-proxy/endpoint/registry"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/multierr"
+)
+
+// proxyPool is a set of proxies with its own discovery, registry and balancer,
+// see config.ProxyPool. It opens the streams of the connections routed to it.
+type proxyPool struct {
+	*endpoint
+
+	settings config.ProxyPool
+
+	statics []staticProxy
+
+	// discovered proxies admitted, nil admits any
+	peers map[peer.ID]struct{}
+
+	registry *registry.Registry
+
+	balancer balancer.Balancer
+
+	// picks the proxy of requests with a session hint
+	sessions balancer.Balancer
+
+	// idle streams per listener protocol, empty unless 'Endpoint.Pool.MinIdle' is set
+	idle map[protocol.Protocol]*pool.Pool
+
+	// wakes up the discovery loop
+	discoverNow chan struct{}
+}
+
+func newProxyPool(e *endpoint, settings config.ProxyPool) (*proxyPool, error) {
+	pp := &proxyPool{
+		endpoint: e,
+		settings: settings,
+		registry: registry.New(registry.Options{
+			TTL:         settings.Health.TTL,
+			MaxFailures: settings.Health.MaxFailures,
+			Backoff:     settings.Health.Backoff,
+			MaxBackoff:  settings.Health.MaxBackoff,
+		}),
+		idle:        make(map[protocol.Protocol]*pool.Pool),
+		discoverNow: make(chan struct{}, 1),
+	}
+	if settings.ProxyMode != config.ProxyModeDiscovery {
+		statics, err := parseStaticProxies(settings.StaticProxies)
+		if err != nil {
+			return nil, err
+		}
+		pp.statics = statics
+	}
+	if len(settings.Peers) > 0 {
+		pp.peers = make(map[peer.ID]struct{}, len(settings.Peers))
+		for _, s := range settings.Peers {
+			id, err := peer.Decode(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid peer [%s]: %s", s, err)
+			}
+			pp.peers[id] = struct{}{}
+		}
+	}
+	return pp, nil
+}
+
+// start runs the discovery and maintenance of the pool until ctx is done.
+func (pp *proxyPool) start(ctx context.Context) (err error) {
+	pp.balancer, err = balancer.New(pp.settings.Balancer, pp)
+	if err != nil {
+		return err
+	}
+	pp.logger.Debugf("Proxy pool [%s] using '%s' balancer", pp.settings.Name, pp.balancer.Name())
+
+	// session hints stick to a proxy whatever the balancer
+	pp.sessions, err = balancer.New(balancer.ConsistentHash, pp)
+	if err != nil {
+		return err
+	}
+
+	if len(pp.statics) > 0 {
+		pp.addStaticProxies()
+		go pp.syncStaticProxies(ctx)
+	}
+	if pp.discoveryEnabled() {
+		// cached proxies make the listeners usable before discovery finishes
+		if cached, err := pp.loadProxyCache(); err != nil {
+			pp.logger.Warn("Load proxy cache ", err)
+		} else if len(cached) > 0 {
+			go pp.refreshCachedProxies(ctx, cached)
+		}
+		go pp.syncProxies(ctx)
+	}
+	go pp.maintainProxies(ctx)
+
+	// streams of keyed balancers go to the owner of the connection key, which idle ones are not for
+	if _, keyed := pp.balancer.(balancer.Keyed); keyed && pp.cfg.Endpoint.Pool.MinIdle > 0 {
+		pp.logger.Infof("Proxy pool [%s] keeps no idle streams for its '%s' balancer", pp.settings.Name, pp.balancer.Name())
+	} else if c := pp.cfg.Endpoint.Pool; c.MinIdle > 0 {
+		opts := pool.Options{MinIdle: c.MinIdle, MaxAge: c.MaxAge}
+		for _, p := range pp.listenerProtocols() {
+			pl := pool.New(pp.dialPooledStream(p), opts)
+			pp.idle[p] = pl
+			go pl.Run(ctx)
+		}
+	}
+	return nil
+}
+
+func (pp *proxyPool) discoveryEnabled() bool {
+	return pp.settings.ProxyMode != config.ProxyModeStatic
+}
+
+// admits reports whether a discovered proxy may join the pool.
+func (pp *proxyPool) admits(id peer.ID) bool {
+	if pp.peers == nil {
+		return true
+	}
+	_, ok := pp.peers[id]
+	return ok
+}
+
+func (pp *proxyPool) maintainProxies(ctx context.Context) {
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			pp.registry.Maintain(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GetProxies returns the proxies of the current registry snapshot, the slice must not be modified.
+// Unless in discovery mode, static proxies are preferred as long as any of them is usable.
+func (pp *proxyPool) GetProxies(p protocol.Protocol) []peer.ID {
+	snapshot := pp.registry.Snapshot()
+	if proxies := snapshot.StaticProxies(p); len(proxies) > 0 {
+		return proxies
+	}
+	return snapshot.Proxies(p)
+}
+
+func (pp *proxyPool) close() error {
+	errs := make([]error, 0, len(pp.idle)+1)
+	for _, pl := range pp.idle {
+		errs = append(errs, pl.Close())
+	}
+	if c, ok := pp.balancer.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	return multierr.Combine(errs...)
+}
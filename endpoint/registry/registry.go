@@ -0,0 +1,337 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type State int
+
+const (
+	// Discovered proxies were advertised but never used yet.
+	Discovered State = iota
+	// Healthy proxies served the last stream opened to them.
+	Healthy
+	// Suspect proxies failed recently, but are still handed out.
+	Suspect
+	// Evicted proxies failed too often and are held back until re-admitted.
+	Evicted
+)
+
+func (s State) String() string {
+	switch s {
+	case Discovered:
+		return "discovered"
+	case Healthy:
+		return "healthy"
+	case Suspect:
+		return "suspect"
+	case Evicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+var DefaultOptions = Options{
+	TTL:         3 * time.Hour,
+	MaxFailures: 3,
+	Backoff:     30 * time.Second,
+	MaxBackoff:  30 * time.Minute,
+}
+
+type Options struct {
+	// proxies not seen for TTL are dropped
+	TTL time.Duration
+	// consecutive failures before a proxy is evicted
+	MaxFailures int
+	// delay before an evicted proxy is re-admitted, doubled on every eviction in a row
+	Backoff time.Duration
+	// upper bound of the re-admission delay
+	MaxBackoff time.Duration
+}
+
+// Entry is the state of one proxy, entries returned by a Snapshot are copies.
+type Entry struct {
+	ID peer.ID
+
+	State State
+
+	// last time the proxy was discovered
+	LastSeen time.Time
+
+	// consecutive failures
+	Failures int
+
+	// consecutive evictions, drives the re-admission backoff
+	Evictions int
+
+	// time an evicted proxy is re-admitted at
+	RetryAt time.Time
+
+	// protocols the proxy supports, nil if unknown
+	Protocols []protocol.Protocol
+
+	// static proxies are configured rather than discovered, they never expire
+	Static bool
+
+	// human readable name of a static proxy, may be empty
+	Alias string
+}
+
+// Registry tracks the known proxies and their health, it is safe for concurrent use.
+type Registry struct {
+	opts Options
+
+	mu      sync.Mutex
+	entries map[peer.ID]*Entry
+
+	// *Snapshot, replaced on every change
+	snapshot atomic.Value
+}
+
+func New(opts Options) *Registry {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultOptions.TTL
+	}
+	if opts.MaxFailures <= 0 {
+		opts.MaxFailures = DefaultOptions.MaxFailures
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultOptions.Backoff
+	}
+	if opts.MaxBackoff < opts.Backoff {
+		opts.MaxBackoff = opts.Backoff
+	}
+	r := &Registry{opts: opts, entries: make(map[peer.ID]*Entry)}
+	r.snapshot.Store(&Snapshot{changed: make(chan struct{})})
+	return r
+}
+
+// Seen adds newly discovered proxies and refreshes the last seen time of known ones.
+func (r *Registry) Seen(ids ...peer.ID) {
+	now := time.Now()
+	r.update(func() {
+		for _, id := range ids {
+			e, ok := r.entries[id]
+			if !ok {
+				e = &Entry{ID: id, State: Discovered}
+				r.entries[id] = e
+			}
+			e.LastSeen = now
+		}
+	})
+}
+
+// AddStatic adds a configured proxy, which is never dropped for not being discovered.
+func (r *Registry) AddStatic(id peer.ID, alias string) {
+	r.update(func() {
+		e, ok := r.entries[id]
+		if !ok {
+			e = &Entry{ID: id, State: Discovered}
+			r.entries[id] = e
+		}
+		e.Static = true
+		e.Alias = alias
+	})
+}
+
+// Restore adds a proxy saved by an earlier run, unless it is already known.
+func (r *Registry) Restore(entry Entry) {
+	r.update(func() {
+		if _, ok := r.entries[entry.ID]; ok {
+			return
+		}
+		e := &Entry{
+			ID:        entry.ID,
+			State:     Discovered,
+			LastSeen:  entry.LastSeen,
+			Failures:  entry.Failures,
+			Protocols: append([]protocol.Protocol(nil), entry.Protocols...),
+		}
+		if e.Failures >= r.opts.MaxFailures {
+			e.Failures = r.opts.MaxFailures - 1
+		}
+		if e.Failures > 0 {
+			e.State = Suspect
+		}
+		r.entries[e.ID] = e
+	})
+}
+
+// SetProtocols records the protocols a known proxy supports.
+func (r *Registry) SetProtocols(id peer.ID, protocols []protocol.Protocol) {
+	r.update(func() {
+		if e, ok := r.entries[id]; ok {
+			e.Protocols = append([]protocol.Protocol(nil), protocols...)
+		}
+	})
+}
+
+// Succeeded records that a stream was opened to the proxy.
+func (r *Registry) Succeeded(id peer.ID) {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	if ok && e.State == Healthy && e.Failures == 0 {
+		// nothing changes, save rebuilding the snapshot on the hot path
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	r.update(func() {
+		if e, ok := r.entries[id]; ok {
+			e.State = Healthy
+			e.Failures = 0
+			e.Evictions = 0
+			e.RetryAt = time.Time{}
+		}
+	})
+}
+
+// Failed records that opening a stream to the proxy failed, the proxy turns
+// suspect and is evicted once it failed MaxFailures times in a row.
+func (r *Registry) Failed(id peer.ID) {
+	r.update(func() {
+		e, ok := r.entries[id]
+		if !ok || e.State == Evicted {
+			return
+		}
+		e.Failures++
+		if e.Failures >= r.opts.MaxFailures {
+			r.evict(e)
+		} else {
+			e.State = Suspect
+		}
+	})
+}
+
+// Evict evicts the proxy at once, whatever its failures.
+func (r *Registry) Evict(id peer.ID) {
+	r.update(func() {
+		if e, ok := r.entries[id]; ok && e.State != Evicted {
+			e.Failures++
+			r.evict(e)
+		}
+	})
+}
+
+// evict must be called with r.mu held.
+func (r *Registry) evict(e *Entry) {
+	backoff := r.opts.Backoff
+	for i := 0; i < e.Evictions && backoff < r.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.opts.MaxBackoff {
+		backoff = r.opts.MaxBackoff
+	}
+	e.State = Evicted
+	e.Evictions++
+	e.RetryAt = time.Now().Add(backoff)
+}
+
+// Maintain drops the proxies not seen for TTL and re-admits the evicted
+// proxies whose backoff elapsed, it should be called periodically.
+func (r *Registry) Maintain(now time.Time) {
+	r.update(func() {
+		for id, e := range r.entries {
+			if !e.Static && now.Sub(e.LastSeen) > r.opts.TTL {
+				delete(r.entries, id)
+				continue
+			}
+			if e.State == Evicted && !now.Before(e.RetryAt) {
+				// one more failure evicts it again, with a longer backoff
+				e.State = Suspect
+				e.Failures = r.opts.MaxFailures - 1
+			}
+		}
+	})
+}
+
+// Snapshot returns the current immutable view of the registry without locking.
+func (r *Registry) Snapshot() *Snapshot {
+	return r.snapshot.Load().(*Snapshot)
+}
+
+func (r *Registry) update(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn()
+	old := r.Snapshot()
+	r.snapshot.Store(r.buildSnapshot())
+	close(old.changed)
+}
+
+// buildSnapshot must be called with r.mu held.
+func (r *Registry) buildSnapshot() *Snapshot {
+	s := &Snapshot{entries: make([]Entry, 0, len(r.entries)), changed: make(chan struct{})}
+	for _, e := range r.entries {
+		entry := *e
+		entry.Protocols = append([]protocol.Protocol(nil), e.Protocols...)
+		s.entries = append(s.entries, entry)
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].ID < s.entries[j].ID })
+	s.usable = make(map[protocol.Protocol][]peer.ID)
+	s.static = make(map[protocol.Protocol][]peer.ID)
+	for _, e := range s.entries {
+		if e.State == Evicted {
+			continue
+		}
+		for _, p := range e.Protocols {
+			s.usable[p] = append(s.usable[p], e.ID)
+			if e.Static {
+				s.static[p] = append(s.static[p], e.ID)
+			}
+		}
+	}
+	return s
+}
+
+// Snapshot is an immutable view of the registry ordered by peer ID,
+// slices it returns must not be modified.
+type Snapshot struct {
+	entries []Entry
+
+	// proxies which can be handed out, by protocol
+	usable map[protocol.Protocol][]peer.ID
+
+	// static proxies which can be handed out, by protocol
+	static map[protocol.Protocol][]peer.ID
+
+	// closed once a newer snapshot replaces this one
+	changed chan struct{}
+}
+
+// Changed returns a channel closed once the registry changed after the snapshot was taken.
+func (s *Snapshot) Changed() <-chan struct{} {
+	return s.changed
+}
+
+// Proxies returns the proxies which can be handed out for protocol p,
+// proxies whose supported protocols are unknown are left out.
+func (s *Snapshot) Proxies(p protocol.Protocol) []peer.ID {
+	return s.usable[p]
+}
+
+// StaticProxies is like Proxies, but only returns the static proxies.
+func (s *Snapshot) StaticProxies(p protocol.Protocol) []peer.ID {
+	return s.static[p]
+}
+
+func (s *Snapshot) Entries() []Entry {
+	return s.entries
+}
+
+func (s *Snapshot) Get(id peer.ID) (Entry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].ID >= id })
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return Entry{}, false
+}
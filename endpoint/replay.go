@@ -0,0 +1,167 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/multierr"
+)
+
+// client bytes kept for replaying on another proxy, connections sending
+// more before any response byte arrived are not replayed
+const maxReplayBuffer = 64 << 10
+
+var errNoResponse = errors.New("proxy closed the stream without responding")
+
+// relay copies between conn and stream like relay.CloseAfterRelay. While no response
+// byte has arrived, the client bytes are buffered, and if the proxy closes the stream
+// the buffer is replayed on a stream to another proxy, up to 'Endpoint.Retry.MaxAttempts'
+// streams in total. Once a response byte was delivered, nothing is retried. Connect
+// streams are not replayed, their proxy reached the target already.
+func (pp *proxyPool) relay(ctx context.Context, req *balancer.Request, conn net.Conn, stream network.Stream) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	up := &replayWriter{stream: stream, replayable: req.Protocol != protocol.Connect}
+	pp.tracker.Opened(up.proxy())
+	defer func() { pp.tracker.Closed(up.proxy()) }()
+
+	ch := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(up, conn)
+		ch <- err
+	}()
+	go func() {
+		ch <- pp.relayResponse(ctx, req, conn, up)
+	}()
+
+	err := <-ch
+	cancel()
+	return multierr.Combine(err, conn.Close(), up.current().Close())
+}
+
+// relayResponse copies the response to conn, replaying the client bytes on
+// another proxy while the current one closes the stream before responding.
+func (pp *proxyPool) relayResponse(ctx context.Context, req *balancer.Request, conn net.Conn, up *replayWriter) error {
+	tried := map[peer.ID]struct{}{up.proxy(): {}}
+	buf := make([]byte, 32<<10)
+	for attempt := 1; ; {
+		stream := up.current()
+		n, err := stream.Read(buf)
+		if n > 0 {
+			up.commit()
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+			_, err = io.Copy(conn, stream)
+			return err
+		}
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			err = errNoResponse
+		} else if _, ok := err.(*handshake.RejectedError); ok {
+			pp.streamFailed(up.proxy(), err)
+		}
+		if attempt >= pp.retry.MaxAttempts || !up.isReplayable() || ctx.Err() != nil {
+			return err
+		}
+		// unless rejected, most likely the proxy failed to reach the target,
+		// which says nothing about its health, so the proxy is not penalized
+		pp.logger.Debugf("Replay to another proxy, [%s], trace %s: %s", up.proxy(), req.TraceID, err)
+
+		// a single attempt, the number of replays is bounded by this loop
+		policy := pp.retry
+		policy.MaxAttempts, policy.Deadline = 1, 0
+		next, err := pp.dialProxyStream(ctx, req, policy, tried)
+		if err != nil {
+			return err
+		}
+		old := up.proxy()
+		if err := up.swap(next); err != nil {
+			next.Reset()
+			return err
+		}
+		stream.Reset()
+		attempt++
+		pp.tracker.Closed(old)
+		pp.tracker.Opened(up.proxy())
+	}
+}
+
+// replayWriter writes the client bytes to the current stream, keeping
+// a copy until the first response byte is committed.
+type replayWriter struct {
+	mu sync.Mutex
+
+	stream network.Stream
+
+	buf []byte
+
+	// false once a response byte arrived or the buffer overflowed
+	replayable bool
+}
+
+func (w *replayWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.replayable {
+		if len(w.buf)+len(b) > maxReplayBuffer {
+			w.replayable, w.buf = false, nil
+		} else {
+			w.buf = append(w.buf, b...)
+		}
+	}
+	n, err := w.stream.Write(b)
+	if err != nil && w.replayable {
+		// kept in the buffer, the broken stream shows up on the response side
+		return len(b), nil
+	}
+	return n, err
+}
+
+// swap replaces the stream, writing the buffered client bytes to the new one first.
+func (w *replayWriter) swap(stream network.Stream) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.replayable {
+		return errNoResponse
+	}
+	if _, err := stream.Write(w.buf); err != nil {
+		return err
+	}
+	w.stream = stream
+	return nil
+}
+
+func (w *replayWriter) commit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.replayable, w.buf = false, nil
+}
+
+func (w *replayWriter) isReplayable() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.replayable
+}
+
+func (w *replayWriter) current() network.Stream {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stream
+}
+
+func (w *replayWriter) proxy() peer.ID {
+	return w.current().Conn().RemotePeer()
+}
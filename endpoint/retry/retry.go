@@ -0,0 +1,150 @@
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+)
+
+var DefaultPolicy = Policy{
+	MaxAttempts:    3,
+	AttemptTimeout: 10 * time.Second,
+	Deadline:       30 * time.Second,
+	Backoff:        100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Jitter:         0.2,
+}
+
+// Policy decides how often and how fast a failed operation is retried.
+type Policy struct {
+	MaxAttempts int
+
+	// timeout of a single attempt, no timeout if zero
+	AttemptTimeout time.Duration
+
+	// deadline of all attempts including the backoff between them, no deadline if zero
+	Deadline time.Duration
+
+	// delay before the second attempt, doubled before every next one
+	Backoff time.Duration
+
+	MaxBackoff time.Duration
+
+	// share of the backoff randomly added or removed, between 0 and 1
+	Jitter float64
+}
+
+// FromConfig builds a policy from 'Endpoint.Retry'. Fields left zero fall back to DefaultPolicy,
+// negative timeouts, deadline, backoff and jitter disable them.
+func FromConfig(c config.Retry) Policy {
+	p := Policy{
+		MaxAttempts:    c.MaxAttempts,
+		AttemptTimeout: c.AttemptTimeout,
+		Deadline:       c.Deadline,
+		Backoff:        c.Backoff,
+		MaxBackoff:     c.MaxBackoff,
+		Jitter:         c.Jitter,
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultPolicy.MaxAttempts
+	}
+	p.AttemptTimeout = orDefault(p.AttemptTimeout, DefaultPolicy.AttemptTimeout)
+	p.Deadline = orDefault(p.Deadline, DefaultPolicy.Deadline)
+	p.Backoff = orDefault(p.Backoff, DefaultPolicy.Backoff)
+	p.MaxBackoff = orDefault(p.MaxBackoff, DefaultPolicy.MaxBackoff)
+	if p.MaxBackoff < p.Backoff {
+		p.MaxBackoff = p.Backoff
+	}
+	switch {
+	case p.Jitter == 0 || p.Jitter > 1:
+		p.Jitter = DefaultPolicy.Jitter
+	case p.Jitter < 0:
+		p.Jitter = 0
+	}
+	return p
+}
+
+// orDefault returns def for zero durations, and zero for negative ones.
+func orDefault(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks err as not worth retrying, Do returns the wrapped error at once.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// Do calls fn until it succeeds, returns a permanent error, the attempts are
+// exhausted or the deadline is exceeded, and returns the last error.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context, attempt int) error) error {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+	var err error
+	for attempt := 1; attempt <= p.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			timer := time.NewTimer(p.backoff(attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+		if err = p.attempt(ctx, attempt, fn); err == nil {
+			return nil
+		}
+		if pe, ok := err.(permanentError); ok {
+			return pe.err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (p Policy) attempt(ctx context.Context, attempt int, fn func(ctx context.Context, attempt int) error) error {
+	if p.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.AttemptTimeout)
+		defer cancel()
+	}
+	return fn(ctx, attempt)
+}
+
+// backoff returns the jittered delay before the given attempt, which starts at 2.
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 2; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 && d > 0 {
+		d += time.Duration(p.Jitter * float64(d) * (2*rand.Float64() - 1))
+	}
+	return d
+}
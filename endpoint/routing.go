@@ -0,0 +1,113 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/endpoint/rule"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/relay"
+)
+
+const (
+	// interval of checking the config file, 'Endpoint.Routing.RulesFile' and 'Endpoint.Routing.GeoIP' for changes
+	rulesWatchInterval = 5 * time.Second
+
+	// timeout of dialing a destination directly
+	directDialTimeout = 10 * time.Second
+)
+
+// watchRules reloads the rules when the config file, the rules file or GeoIP database changed,
+// keeping the current ones if the new ones are invalid. The 'Endpoint.Routing' section is read
+// from the config file again, files it names newly are watched only after a restart though.
+func (e *endpoint) watchRules(ctx context.Context) {
+	reload := func() {
+		c := e.cfg
+		if len(e.cfg.Path()) > 0 {
+			reloaded, err := e.cfg.Reload()
+			if err != nil {
+				e.logger.Warn("Reload config file, keep the current routing rules: ", err)
+				return
+			}
+			c = reloaded
+		}
+		set, err := rule.Load(c)
+		if err != nil {
+			e.logger.Warn("Reload routing rules, keep the current ones: ", err)
+			return
+		}
+		e.rules.Store(set)
+		e.logger.Info("Reloaded routing rules")
+	}
+	if len(e.cfg.Path()) > 0 {
+		go config.WatchFile(ctx, e.cfg.Path(), rulesWatchInterval, reload)
+	}
+	for _, f := range []string{e.cfg.Endpoint.Routing.RulesFile, e.cfg.Endpoint.Routing.GeoIP} {
+		if len(f) == 0 {
+			continue
+		}
+		file, err := e.cfg.ResolvePath(f)
+		if err != nil {
+			continue
+		}
+		go config.WatchFile(ctx, file, rulesWatchInterval, reload)
+	}
+}
+
+// route applies the routing rules to a connection whose destination is known, and reports
+// whether it was handled, otherwise it is relayed through a proxy of the decision pool.
+func (e *endpoint) route(ctx context.Context, pc protocol.Conn) (rule.Decision, bool) {
+	target := pc.Target()
+	decision := e.rules.Match(target)
+	switch decision.Action {
+	case rule.Reject:
+		e.logger.Debugf("Reject [%s] of [%s] by rule %d", target, pc.RemoteAddr(), decision.Rule)
+		pc, _ = terminate(pc)
+		pc.Reply(protocol.ErrNotAllowed)
+		pc.Close()
+		return decision, true
+	case rule.Direct:
+		// connections which cannot be terminated are relayed in their client protocol
+		pc, ok := terminate(pc)
+		if !ok {
+			return decision, false
+		}
+		e.relayDirect(ctx, pc, target)
+		return decision, true
+	default:
+		return decision, false
+	}
+}
+
+func (e *endpoint) relayDirect(ctx context.Context, pc protocol.Conn, target string) {
+	dialer := &net.Dialer{Timeout: directDialTimeout, KeepAlive: 30 * time.Second}
+	rc, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		e.logger.Debugf("Dial [%s] directly: %s", target, err)
+		pc.Reply(err)
+		pc.Close()
+		return
+	}
+	if err := pc.Reply(nil); err != nil {
+		rc.Close()
+		pc.Close()
+		return
+	}
+	if err := relay.CloseAfterRelay(pc, rc); e.errorTriggeredByStop(err) != nil {
+		e.logger.Debug("Direct relay failure: ", err)
+	}
+}
+
+// terminate returns the connection answering the client itself, and whether pc was
+// terminated already or could be.
+func terminate(pc protocol.Conn) (protocol.Conn, bool) {
+	if pc.Protocol() == protocol.Connect {
+		return pc, true
+	}
+	if t, ok := pc.(protocol.Terminator); ok {
+		return t.Terminate(), true
+	}
+	return pc, false
+}
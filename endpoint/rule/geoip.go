@@ -0,0 +1,89 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP maps IP ranges to country codes, loaded from a CSV file of 'cidr,country' lines,
+// as the country CIDR lists published for firewalls are easily converted to. The CIDRs
+// must not overlap, so each IP has one country.
+type GeoIP struct {
+	// sorted by start, not overlapping
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start, end net.IP
+
+	country string
+
+	// of the file, for reporting overlaps
+	line int
+}
+
+func LoadGeoIP(file string) (*GeoIP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &GeoIP{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expect 'cidr,country'", file, n)
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		start := ipNet.IP.To16()
+		end := make(net.IP, len(start))
+		mask := net.IP(ipNet.Mask)
+		if len(mask) == net.IPv4len {
+			mask = append(net.IP{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, mask...)
+		}
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+		g.ranges = append(g.ranges, ipRange{start: start, end: end, country: strings.ToUpper(strings.TrimSpace(fields[1])), line: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(g.ranges, func(i, j int) bool { return bytes.Compare(g.ranges[i].start, g.ranges[j].start) < 0 })
+	for i := 1; i < len(g.ranges); i++ {
+		if prev, r := g.ranges[i-1], g.ranges[i]; bytes.Compare(r.start, prev.end) <= 0 {
+			return nil, fmt.Errorf("%s:%d: range overlaps the one of line %d", file, r.line, prev.line)
+		}
+	}
+	return g, nil
+}
+
+// Country returns the country code of ip, empty if unknown.
+func (g *GeoIP) Country(ip net.IP) string {
+	if g == nil {
+		return ""
+	}
+	ip = ip.To16()
+	i := sort.Search(len(g.ranges), func(i int) bool { return bytes.Compare(g.ranges[i].start, ip) > 0 })
+	if i == 0 {
+		return ""
+	}
+	if r := g.ranges[i-1]; bytes.Compare(ip, r.end) <= 0 {
+		return r.country
+	}
+	return ""
+}
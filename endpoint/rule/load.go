@@ -0,0 +1,58 @@
+package rule
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/diandianl/p2p-proxy/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Load compiles the 'Endpoint.Routing' rules, followed by the ones of its 'RulesFile'.
+func Load(cfg *config.Config) (*Set, error) {
+	c := cfg.Endpoint.Routing
+	def, err := ParseAction(c.Default)
+	if err != nil {
+		return nil, err
+	}
+	rules := append([]config.Rule(nil), c.Rules...)
+	if len(c.RulesFile) > 0 {
+		file, err := cfg.ResolvePath(c.RulesFile)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var rf struct {
+			Rules []config.Rule `yaml:"Rules"`
+		}
+		if err := yaml.Unmarshal(data, &rf); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		rules = append(rules, rf.Rules...)
+	}
+	pools := make(map[string]struct{})
+	for _, pool := range cfg.ProxyPools() {
+		pools[pool.Name] = struct{}{}
+	}
+	for i, r := range rules {
+		if _, ok := pools[r.Pool]; !ok && len(r.Pool) > 0 {
+			return nil, fmt.Errorf("rule %d: unknown proxy pool [%s]", i, r.Pool)
+		}
+	}
+
+	var geoIP *GeoIP
+	if len(c.GeoIP) > 0 {
+		file, err := cfg.ResolvePath(c.GeoIP)
+		if err != nil {
+			return nil, err
+		}
+		if geoIP, err = LoadGeoIP(file); err != nil {
+			return nil, err
+		}
+	}
+	return Compile(rules, geoIP, def)
+}
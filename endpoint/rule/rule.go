@@ -0,0 +1,266 @@
+// Package rule decides per destination whether a connection is dialed directly
+// by the endpoint, relayed through a proxy pool or rejected.
+package rule
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/diandianl/p2p-proxy/config"
+)
+
+type Action string
+
+const (
+	Direct Action = "direct"
+
+	Proxy Action = "proxy"
+
+	Reject Action = "reject"
+)
+
+func ParseAction(s string) (Action, error) {
+	switch a := Action(strings.ToLower(s)); a {
+	case Direct, Proxy, Reject:
+		return a, nil
+	case "":
+		return Proxy, nil
+	default:
+		return "", fmt.Errorf("unsupported rule action [%s]", s)
+	}
+}
+
+// Decision is the outcome of matching a destination.
+type Decision struct {
+	Action Action
+
+	// proxy pool of the Proxy action, empty for the default one
+	Pool string
+
+	// index of the matched rule, -1 if none matched
+	Rule int
+}
+
+// Set is an immutable list of compiled rules, the first one matching decides.
+type Set struct {
+	rules []*rule
+
+	geoIP *GeoIP
+
+	def Decision
+}
+
+type rule struct {
+	domainSuffix []string
+
+	domainKeyword []string
+
+	cidrs []*net.IPNet
+
+	ports []portRange
+
+	countries []string
+
+	action Action
+
+	pool string
+}
+
+type portRange struct {
+	from, to int
+}
+
+// Compile compiles the rules, geoIP is needed by rules matching countries only.
+func Compile(rules []config.Rule, geoIP *GeoIP, def Action) (*Set, error) {
+	s := &Set{geoIP: geoIP, def: Decision{Action: def, Rule: -1}}
+	for i, c := range rules {
+		r, err := compile(c)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err)
+		}
+		if len(r.countries) > 0 && geoIP == nil {
+			return nil, fmt.Errorf("rule %d: matching GeoIP requires a 'GeoIP' database", i)
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+func compile(c config.Rule) (*rule, error) {
+	action, err := ParseAction(c.Action)
+	if err != nil {
+		return nil, err
+	}
+	r := &rule{action: action, pool: c.Pool}
+	for _, d := range c.DomainSuffix {
+		r.domainSuffix = append(r.domainSuffix, strings.ToLower(strings.TrimPrefix(d, ".")))
+	}
+	for _, k := range c.DomainKeyword {
+		r.domainKeyword = append(r.domainKeyword, strings.ToLower(k))
+	}
+	for _, cidr := range c.CIDR {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.cidrs = append(r.cidrs, ipNet)
+	}
+	for _, p := range c.Ports {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		r.ports = append(r.ports, pr)
+	}
+	for _, country := range c.GeoIP {
+		r.countries = append(r.countries, strings.ToUpper(country))
+	}
+	if len(r.domainSuffix)+len(r.domainKeyword)+len(r.cidrs)+len(r.ports)+len(r.countries) == 0 {
+		return nil, fmt.Errorf("no condition")
+	}
+	return r, nil
+}
+
+// parsePortRange parses a port, or a range like 8000-9000.
+func parsePortRange(s string) (portRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port [%s]", s)
+	}
+	t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || t < f {
+		return portRange{}, fmt.Errorf("invalid port [%s]", s)
+	}
+	return portRange{int(f), int(t)}, nil
+}
+
+// Match decides for target host:port. Domains are not resolved,
+// so CIDR and GeoIP conditions only match targets given as IP.
+func (s *Set) Match(target string) Decision {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	port, _ := strconv.Atoi(portStr)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for i, r := range s.rules {
+		if r.match(s.geoIP, host, ip, port) {
+			return Decision{Action: r.action, Pool: r.pool, Rule: i}
+		}
+	}
+	return s.def
+}
+
+// match reports whether every kind of condition the rule has matches, any of its values do.
+func (r *rule) match(geoIP *GeoIP, host string, ip net.IP, port int) bool {
+	if len(r.domainSuffix) > 0 || len(r.domainKeyword) > 0 {
+		if ip != nil || !(matchSuffix(r.domainSuffix, host) || matchKeyword(r.domainKeyword, host)) {
+			return false
+		}
+	}
+	if len(r.cidrs) > 0 && (ip == nil || !matchCIDR(r.cidrs, ip)) {
+		return false
+	}
+	if len(r.countries) > 0 && (ip == nil || !contains(r.countries, geoIP.Country(ip))) {
+		return false
+	}
+	if len(r.ports) > 0 && !matchPort(r.ports, port) {
+		return false
+	}
+	return true
+}
+
+func matchSuffix(suffixes []string, host string) bool {
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKeyword(keywords []string, host string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(host, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCIDR(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ports []portRange, port int) bool {
+	for _, p := range ports {
+		if port >= p.from && port <= p.to {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine holds the current rule set, replaced as a whole on reload.
+type Engine struct {
+	set atomic.Value
+}
+
+func NewEngine(s *Set) *Engine {
+	e := &Engine{}
+	e.set.Store(s)
+	return e
+}
+
+func (e *Engine) Store(s *Set) {
+	e.set.Store(s)
+}
+
+func (e *Engine) Match(target string) Decision {
+	return e.set.Load().(*Set).Match(target)
+}
+
+// Set returns the current rule set.
+func (e *Engine) Set() *Set {
+	return e.set.Load().(*Set)
+}
+
+// Default returns the action if no rule matches.
+func (s *Set) Default() Action {
+	return s.def.Action
+}
+
+// DirectDomains returns the domain suffixes of the rules dialing directly
+// without any other condition, e.g. to tell browsers to skip the proxy.
+func (s *Set) DirectDomains() []string {
+	var domains []string
+	for _, r := range s.rules {
+		if r.action == Direct && len(r.cidrs)+len(r.ports)+len(r.countries)+len(r.domainKeyword) == 0 {
+			domains = append(domains, r.domainSuffix...)
+		}
+	}
+	return domains
+}
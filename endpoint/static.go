@@ -0,0 +1,87 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	maddr "github.com/multiformats/go-multiaddr"
+)
+
+// interval of re-dialing the static proxies, which also picks up protocol changes
+const staticProbeInterval = time.Minute
+
+type staticProxy struct {
+	alias string
+
+	addr peer.AddrInfo
+}
+
+// parseStaticProxies parses the 'Endpoint.StaticProxies' config,
+// entries are full multiaddrs optionally prefixed by 'alias='.
+func parseStaticProxies(addrs []string) ([]staticProxy, error) {
+	proxies := make([]staticProxy, 0, len(addrs))
+	for _, addr := range addrs {
+		var alias string
+		if i := strings.Index(addr, "="); i >= 0 {
+			alias, addr = strings.TrimSpace(addr[:i]), strings.TrimSpace(addr[i+1:])
+		}
+		ma, err := maddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static proxy [%s]: %s", addr, err)
+		}
+		info, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			return nil, fmt.Errorf("invalid static proxy [%s]: %s", addr, err)
+		}
+		proxies = append(proxies, staticProxy{alias: alias, addr: *info})
+	}
+	return proxies, nil
+}
+
+func (pp *proxyPool) addStaticProxies() {
+	for _, proxy := range pp.statics {
+		pp.node.Peerstore().AddAddrs(proxy.addr.ID, proxy.addr.Addrs, peerstore.PermanentAddrTTL)
+		pp.registry.AddStatic(proxy.addr.ID, proxy.alias)
+	}
+}
+
+func (pp *proxyPool) syncStaticProxies(ctx context.Context) {
+	ticker := time.NewTicker(staticProbeInterval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, proxy := range pp.statics {
+			wg.Add(1)
+			go func(proxy staticProxy) {
+				defer wg.Done()
+				pp.probeStaticProxy(ctx, proxy)
+			}(proxy)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (pp *proxyPool) probeStaticProxy(ctx context.Context, proxy staticProxy) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if err := pp.node.Connect(ctx, proxy.addr); err != nil {
+		pp.logger.Warnf("Connect to static proxy [%s]: %s", proxy.addr.ID, err)
+		return
+	}
+	protocols := pp.supportedProtocols(proxy.addr.ID)
+	if len(protocols) == 0 {
+		pp.logger.Warnf("Static proxy [%s] serves none of the listener protocols", proxy.addr.ID)
+	}
+	pp.registry.SetProtocols(proxy.addr.ID, protocols)
+}
@@ -0,0 +1,346 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/endpoint/balancer"
+	"github.com/diandianl/p2p-proxy/endpoint/pool"
+	"github.com/diandianl/p2p-proxy/endpoint/retry"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/connect"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	p2pproto "github.com/libp2p/go-libp2p-core/protocol"
+)
+
+const (
+	// proxies raced against each other when 'Endpoint.Race' is enabled
+	raceWidth = 2
+
+	// default of 'Endpoint.Race.Stagger'
+	defaultRaceStagger = 300 * time.Millisecond
+)
+
+// newProxyStream opens a stream to a proxy serving the requested protocol,
+// following the 'Endpoint.Retry' policy and failing over to another proxy on errors.
+func (pp *proxyPool) newProxyStream(ctx context.Context, req *balancer.Request) (network.Stream, error) {
+	// idle streams are to the proxies the balancer picks, not to hinted ones
+	if pl, ok := pp.idle[req.Protocol]; ok && !picksProxy(req.Hints) {
+		if stream := pl.Get(pp.pooledStreamUsable(req.Protocol)); stream != nil {
+			if stream, err := pp.pipelineHandshake(stream, req); err == nil {
+				return stream, nil
+			}
+		}
+	}
+	if len(pp.GetProxies(req.Protocol)) == 0 {
+		if err := pp.waitProxies(ctx, req.Protocol); err != nil {
+			return nil, err
+		}
+	}
+	return pp.dialProxyStream(ctx, req, pp.retry, make(map[peer.ID]struct{}))
+}
+
+// newConnectStream opens a Connect protocol stream to req.Destination, and waits for the proxy
+// to connect it, before any client byte is sent. Proxies rejecting the stream or failing to
+// reach the target are failed over to another one, up to 'Endpoint.Retry.MaxAttempts' streams,
+// targets denied by the egress policy of a proxy are not.
+func (pp *proxyPool) newConnectStream(ctx context.Context, req *balancer.Request) (network.Stream, error) {
+	stream, err := pp.newProxyStream(ctx, req)
+	tried := make(map[peer.ID]struct{})
+	for attempt := 1; ; attempt++ {
+		if err != nil {
+			return nil, err
+		}
+		proxy := stream.Conn().RemotePeer()
+		tried[proxy] = struct{}{}
+		if err = connectTarget(ctx, stream, req.Destination); err == nil {
+			return stream, nil
+		}
+		stream.Reset()
+		if _, ok := err.(*handshake.RejectedError); ok {
+			pp.streamFailed(proxy, err)
+		}
+		if errors.Is(err, protocol.ErrNotAllowed) || attempt >= pp.retry.MaxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+		pp.logger.Debugf("Connect through another proxy, [%s], trace %s: %s", proxy, req.TraceID, err)
+
+		policy := pp.retry
+		policy.MaxAttempts, policy.Deadline = 1, 0
+		stream, err = pp.dialProxyStream(ctx, req, policy, tried)
+	}
+}
+
+// connectTarget sends the header of a Connect stream and reads the reply.
+func connectTarget(ctx context.Context, s network.Stream, target string) error {
+	if err := connect.WriteTarget(s, target); err != nil {
+		return err
+	}
+	return awaitRead(ctx, s, func() error {
+		return connect.ReadReply(s)
+	})
+}
+
+// dialProxyStream opens a stream following policy, to proxies not in tried if possible,
+// and adds the proxies picked to tried.
+func (pp *proxyPool) dialProxyStream(ctx context.Context, req *balancer.Request, policy retry.Policy, tried map[peer.ID]struct{}) (network.Stream, error) {
+	width := 1
+	if pp.cfg.Endpoint.Race.Enable {
+		width = raceWidth
+	}
+	var stream network.Stream
+	err := policy.Do(ctx, func(ctx context.Context, attempt int) error {
+		proxies, err := pp.pickProxies(req, width, tried)
+		if err != nil {
+			return retry.Permanent(err)
+		}
+		if len(proxies) > 1 {
+			stream, err = pp.raceStreams(ctx, req, proxies)
+			return err
+		}
+		stream, err = pp.openStream(ctx, proxies[0], req, false)
+		if err != nil {
+			pp.logger.Debugf("Open stream to proxy [%s], attempt %d, trace %s: %s", proxies[0], attempt, req.TraceID, err)
+			pp.streamFailed(proxies[0], err)
+			return err
+		}
+		pp.streamSucceeded(proxies[0])
+		return nil
+	})
+	return stream, err
+}
+
+// dialPooledStream opens an idle stream of protocol p for the pool, to the proxy the balancer picks.
+func (pp *proxyPool) dialPooledStream(p protocol.Protocol) pool.Dialer {
+	return func(ctx context.Context) (network.Stream, error) {
+		proxies, err := balancer.Candidates(pp.balancer, &balancer.Request{Protocol: p}, 1)
+		if err != nil {
+			return nil, err
+		}
+		// the handshake is sent once a connection takes the stream
+		stream, err := pp.dialStream(ctx, proxies[0], p, true)
+		if err != nil {
+			pp.logger.Debugf("Open idle stream to proxy [%s]: %s", proxies[0], err)
+			pp.streamFailed(proxies[0], err)
+			return nil, err
+		}
+		pp.streamSucceeded(proxies[0])
+		return stream, nil
+	}
+}
+
+// pooledStreamUsable accepts idle streams whose proxy is still connected and usable for protocol p.
+func (pp *proxyPool) pooledStreamUsable(p protocol.Protocol) func(network.Stream) bool {
+	return func(stream network.Stream) bool {
+		proxy := stream.Conn().RemotePeer()
+		return pp.node.Network().Connectedness(proxy) == network.Connected &&
+			containsProxy(pp.GetProxies(p), proxy)
+	}
+}
+
+// pickProxies asks the balancer for up to n proxies, preferring the ones not tried yet,
+// which are then marked tried. A request pinned to a proxy by its hints gets only that one.
+func (pp *proxyPool) pickProxies(req *balancer.Request, n int, tried map[peer.ID]struct{}) ([]peer.ID, error) {
+	pinned, err := pp.hintedProxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if pinned != balancer.NoProxy {
+		tried[pinned] = struct{}{}
+		return []peer.ID{pinned}, nil
+	}
+	candidates, err := balancer.Candidates(pp.balancerOf(req), req, n)
+	if err != nil {
+		return nil, err
+	}
+	proxies := make([]peer.ID, 0, n)
+	for _, proxy := range candidates {
+		if _, ok := tried[proxy]; !ok {
+			proxies = append(proxies, proxy)
+		}
+	}
+	for _, proxy := range pp.GetProxies(req.Protocol) {
+		if len(proxies) >= n {
+			break
+		}
+		if _, ok := tried[proxy]; !ok && !containsProxy(proxies, proxy) {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if len(proxies) == 0 {
+		// every proxy was tried, give the balancer's choice another chance
+		proxies = candidates[:1]
+	}
+	for _, proxy := range proxies {
+		tried[proxy] = struct{}{}
+	}
+	return proxies, nil
+}
+
+func containsProxy(proxies []peer.ID, proxy peer.ID) bool {
+	for _, p := range proxies {
+		if p == proxy {
+			return true
+		}
+	}
+	return false
+}
+
+// raceStreams opens a stream to the first proxy, then every 'Endpoint.Race.Stagger',
+// or at once when one fails, to the next one. The first stream to complete
+// multistream negotiation and the handshake wins, the others are canceled.
+func (pp *proxyPool) raceStreams(ctx context.Context, req *balancer.Request, proxies []peer.ID) (network.Stream, error) {
+	stagger := pp.cfg.Endpoint.Race.Stagger
+	if stagger <= 0 {
+		stagger = defaultRaceStagger
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		proxy  peer.ID
+		stream network.Stream
+		err    error
+	}
+	results := make(chan result, len(proxies))
+	next, pending := 0, 0
+	start := func() {
+		proxy := proxies[next]
+		next++
+		pending++
+		go func() {
+			s, err := pp.openStream(ctx, proxy, req, true)
+			results <- result{proxy, s, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(stagger)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(proxies) {
+				start()
+				timer.Reset(stagger)
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				if ctx.Err() == nil {
+					pp.logger.Debugf("Race stream to proxy [%s]: %s", r.proxy, r.err)
+					pp.streamFailed(r.proxy, r.err)
+				}
+				lastErr = r.err
+				if next < len(proxies) {
+					start()
+				}
+				continue
+			}
+			cancel()
+			// losers completing anyway are reset
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.err == nil {
+						r.stream.Reset()
+					}
+				}
+			}(pending)
+			pp.streamSucceeded(r.proxy)
+			return r.stream, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// openStream opens a stream to proxy and runs the handshake if the proxy supports it.
+// Unless negotiate is set, an original protocol version stream may not be negotiated yet.
+func (e *endpoint) openStream(ctx context.Context, proxy peer.ID, req *balancer.Request, negotiate bool) (network.Stream, error) {
+	s, err := e.dialStream(ctx, proxy, req.Protocol, negotiate)
+	if err != nil {
+		return nil, err
+	}
+	if s.Protocol() != p2pproto.ID(handshake.ID(req.Protocol)) {
+		return s, nil
+	}
+	if err := e.handshake(ctx, s, req); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// dialStream opens a stream of the handshake version of p, or of p itself for proxies
+// not supporting it. If negotiate is set, it waits for the multistream negotiation, which
+// the host otherwise defers to the first read when the peerstore knows the proxy protocols.
+func (e *endpoint) dialStream(ctx context.Context, proxy peer.ID, p protocol.Protocol, negotiate bool) (network.Stream, error) {
+	versioned := handshake.ID(p)
+	supported, _ := e.node.Peerstore().SupportsProtocols(proxy, string(versioned), string(p))
+	s, err := e.node.NewStream(ctx, proxy, p2pproto.ID(versioned), p2pproto.ID(p))
+	if err != nil || !negotiate || len(supported) == 0 {
+		// negotiated eagerly by NewStream if the protocols are not known
+		return s, err
+	}
+	err = awaitRead(ctx, s, func() error {
+		_, err := s.Read(nil)
+		return err
+	})
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	return s, nil
+}
+
+// awaitRead runs read on s, giving up once ctx is done.
+func awaitRead(ctx context.Context, s network.Stream, read func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetReadDeadline(deadline)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- read()
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		s.SetReadDeadline(time.Time{})
+	}
+	return err
+}
+
+func (pp *proxyPool) streamSucceeded(proxy peer.ID) {
+	pp.registry.Succeeded(proxy)
+	if entry, ok := pp.registry.Snapshot().Get(proxy); ok && entry.Protocols == nil {
+		pp.registry.SetProtocols(proxy, pp.supportedProtocols(proxy))
+	}
+}
+
+// streamFailed reports a failure of opening a stream to the balancer and registry,
+// which evicts the proxy at once if 'Endpoint.Retry.Evict' is set. Of the rejections,
+// only an overloaded proxy counts as failed, one refusing access is evicted.
+func (pp *proxyPool) streamFailed(proxy peer.ID, err error) {
+	if rejected, ok := err.(*handshake.RejectedError); ok && rejected.Status != handshake.StatusOverloaded {
+		pp.registry.Evict(proxy)
+		return
+	}
+	if fb, ok := pp.balancer.(balancer.Feedback); ok {
+		fb.StreamFailed(proxy, err)
+	}
+	if pp.cfg.Endpoint.Retry.Evict {
+		pp.registry.Evict(proxy)
+	} else {
+		pp.registry.Failed(proxy)
+	}
+}
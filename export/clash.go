@@ -0,0 +1,71 @@
+package export
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const clashGroup = "p2p-proxy"
+
+type clashConfig struct {
+	Proxies []clashProxy `yaml:"proxies"`
+
+	ProxyGroups []clashGroupConfig `yaml:"proxy-groups"`
+
+	Rules []string `yaml:"rules"`
+}
+
+type clashProxy struct {
+	Name string `yaml:"name"`
+
+	Type string `yaml:"type"`
+
+	Server string `yaml:"server"`
+
+	Port int `yaml:"port"`
+
+	Cipher string `yaml:"cipher,omitempty"`
+
+	Password string `yaml:"password,omitempty"`
+}
+
+type clashGroupConfig struct {
+	Name string `yaml:"name"`
+
+	Type string `yaml:"type"`
+
+	Proxies []string `yaml:"proxies"`
+}
+
+// Clash returns a Clash style config with a proxy per listener, a group selecting
+// among them, and rules sending the direct domains around it.
+func Clash(listeners []Listener, cipher, password string, directDomains []string) ([]byte, error) {
+	cfg := clashConfig{}
+	group := clashGroupConfig{Name: clashGroup, Type: "select"}
+	for i, l := range listeners {
+		p := clashProxy{Server: l.Host, Port: l.Port}
+		switch l.Kind {
+		case HTTP:
+			p.Type = "http"
+		case Socks5:
+			p.Type = "socks5"
+		case Shadowsocks:
+			p.Type = "ss"
+			p.Cipher, p.Password = strings.ToLower(cipher), password
+		}
+		p.Name = fmt.Sprintf("p2p-%s-%d", p.Type, i+1)
+		cfg.Proxies = append(cfg.Proxies, p)
+		group.Proxies = append(group.Proxies, p.Name)
+	}
+	if len(cfg.Proxies) == 0 {
+		return nil, fmt.Errorf("no listener in 'Endpoint.ProxyProtocols' usable by Clash")
+	}
+	cfg.ProxyGroups = []clashGroupConfig{group}
+	for _, d := range directDomains {
+		cfg.Rules = append(cfg.Rules, "DOMAIN-SUFFIX,"+d+",DIRECT")
+	}
+	cfg.Rules = append(cfg.Rules, "MATCH,"+clashGroup)
+	return yaml.Marshal(cfg)
+}
@@ -0,0 +1,38 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Env returns shell exports of the proxy environment variables and a curl example.
+func Env(listeners []Listener, directDomains []string) ([]byte, error) {
+	httpL, hasHTTP := First(listeners, HTTP)
+	socksL, hasSocks := First(listeners, Socks5)
+	if !hasHTTP && !hasSocks {
+		return nil, fmt.Errorf("no HTTP or SOCKS5 listener in 'Endpoint.ProxyProtocols'")
+	}
+
+	var buf bytes.Buffer
+	if hasHTTP {
+		u := "http://" + httpL.Addr()
+		fmt.Fprintf(&buf, "export http_proxy=%s\nexport https_proxy=%s\n", u, u)
+		fmt.Fprintf(&buf, "export HTTP_PROXY=%s\nexport HTTPS_PROXY=%s\n", u, u)
+	}
+	if hasSocks {
+		u := "socks5h://" + socksL.Addr()
+		fmt.Fprintf(&buf, "export all_proxy=%s\nexport ALL_PROXY=%s\n", u, u)
+	}
+	noProxy := strings.Join(append([]string{"localhost", "127.0.0.1"}, directDomains...), ",")
+	fmt.Fprintf(&buf, "export no_proxy=%s\nexport NO_PROXY=%s\n", noProxy, noProxy)
+
+	buf.WriteString("\n# curl\n")
+	if hasHTTP {
+		fmt.Fprintf(&buf, "# curl -x http://%s https://example.com\n", httpL.Addr())
+	}
+	if hasSocks {
+		fmt.Fprintf(&buf, "# curl -x socks5h://%s https://example.com\n", socksL.Addr())
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,81 @@
+// Package export generates client configurations pointing at the local listeners
+// of the endpoint: a PAC file, a shadowsocks URI, shell exports and a Clash config.
+package export
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/protocol"
+)
+
+// Kind of client protocol a local listener speaks.
+type Kind int
+
+const (
+	HTTP Kind = iota
+
+	Socks5
+
+	Shadowsocks
+)
+
+// Listener is a local listener as clients reach it.
+type Listener struct {
+	Kind Kind
+
+	Host string
+
+	Port int
+}
+
+func (l Listener) Addr() string {
+	return net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+}
+
+// kinds of client protocols each listener accepts
+var listenerKinds = map[protocol.Protocol][]Kind{
+	protocol.HTTP:          {HTTP},
+	protocol.ConnectHTTP:   {HTTP},
+	protocol.Socks5:        {Socks5},
+	protocol.ConnectSocks5: {Socks5},
+	protocol.Mixed:         {HTTP, Socks5},
+	protocol.Shadowsocks:   {Shadowsocks},
+}
+
+// Listeners returns the 'Endpoint.ProxyProtocols' listeners clients can use, in config order.
+// Listeners on an unspecified address are reached at host, loopback if it is empty.
+func Listeners(cfg *config.Config, host string) []Listener {
+	var listeners []Listener
+	for _, p := range cfg.Endpoint.ProxyProtocols {
+		h, portStr, err := net.SplitHostPort(p.Listen)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(h); len(h) == 0 || ip != nil && ip.IsUnspecified() {
+			h = host
+			if len(h) == 0 {
+				h = "127.0.0.1"
+			}
+		}
+		for _, kind := range listenerKinds[protocol.Protocol(p.Protocol)] {
+			listeners = append(listeners, Listener{Kind: kind, Host: h, Port: port})
+		}
+	}
+	return listeners
+}
+
+// First returns the first listener of kind.
+func First(listeners []Listener, kind Kind) (Listener, bool) {
+	for _, l := range listeners {
+		if l.Kind == kind {
+			return l, true
+		}
+	}
+	return Listener{}, false
+}
@@ -0,0 +1,56 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+var pacTemplate = template.Must(template.New("pac").Parse(`// generated by p2p-proxy
+var direct = {{.Direct}};
+
+function FindProxyForURL(url, host) {
+    if (isPlainHostName(host)) {
+        return "DIRECT";
+    }
+    host = host.toLowerCase();
+    for (var i = 0; i < direct.length; i++) {
+        if (host === direct[i] || dnsDomainIs(host, "." + direct[i])) {
+            return "DIRECT";
+        }
+    }
+    return "{{.Proxy}}";
+}
+`))
+
+// PAC returns a proxy auto-config file sending the direct domains around the proxy,
+// and everything else through the HTTP listeners, then the SOCKS5 ones.
+func PAC(listeners []Listener, directDomains []string) ([]byte, error) {
+	var proxies []string
+	for _, l := range listeners {
+		switch l.Kind {
+		case HTTP:
+			proxies = append(proxies, "PROXY "+l.Addr())
+		case Socks5:
+			proxies = append(proxies, "SOCKS5 "+l.Addr())
+		}
+	}
+	if len(proxies) == 0 {
+		return nil, fmt.Errorf("no HTTP or SOCKS5 listener in 'Endpoint.ProxyProtocols'")
+	}
+
+	quoted := make([]string, 0, len(directDomains))
+	for _, d := range directDomains {
+		quoted = append(quoted, fmt.Sprintf("%q", strings.ToLower(d)))
+	}
+	var buf bytes.Buffer
+	err := pacTemplate.Execute(&buf, struct {
+		Direct string
+		Proxy  string
+	}{
+		Direct: "[" + strings.Join(quoted, ", ") + "]",
+		Proxy:  strings.Join(proxies, "; "),
+	})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,41 @@
+package export
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/protocol"
+)
+
+// defaults of the shadowsocks service
+const (
+	defaultCipher = "AES-128-GCM"
+
+	defaultPassword = "123456"
+)
+
+// ShadowsocksCredentials returns the cipher and password of the shadowsocks service in 'Proxy.Protocols'.
+func ShadowsocksCredentials(cfg *config.Config) (cipher, password string) {
+	cipher, password = defaultCipher, defaultPassword
+	for _, p := range cfg.Proxy.Protocols {
+		if protocol.Protocol(p.Protocol) != protocol.Shadowsocks {
+			continue
+		}
+		if c, ok := p.Config["Ciper"].(string); ok {
+			cipher = c
+		}
+		if pw, ok := p.Config["Password"].(string); ok {
+			password = pw
+		}
+	}
+	return cipher, password
+}
+
+// ShadowsocksURI returns the SIP002 URI of the shadowsocks listener.
+func ShadowsocksURI(l Listener, cipher, password, name string) string {
+	userInfo := base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(cipher) + ":" + password))
+	return fmt.Sprintf("ss://%s@%s#%s", userInfo, l.Addr(), url.PathEscape(name))
+}
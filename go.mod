@@ -7,6 +7,7 @@ require (
 	github.com/elazarl/goproxy v0.0.0-20191011121108-aa519ddbe484
 	github.com/ipfs/go-cid v0.0.5
 	github.com/ipfs/go-datastore v0.4.4
+	github.com/ipfs/go-ds-leveldb v0.4.2
 	github.com/ipfs/go-log v1.0.2 // indirect
 	github.com/ipfs/go-log/v2 v2.0.2
 	github.com/libp2p/go-libp2p v0.5.2
@@ -2,7 +2,6 @@ package p2p
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"time"
 
@@ -10,7 +9,6 @@ import (
 	"github.com/diandianl/p2p-proxy/log"
 
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/metrics"
 	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
 )
@@ -45,11 +43,7 @@ func dhtOptions(c *config.Config) ([]dhtopts.Option, error) {
 }
 
 func identity(privKey string) (libp2p.Option, error) {
-	priv, err := base64.StdEncoding.DecodeString(privKey)
-	if err != nil {
-		return nil, err
-	}
-	pk, err := crypto.UnmarshalPrivateKey(priv)
+	pk, err := config.DecodePrivKey(privKey)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,81 @@
+// Package connect implements the header of Connect protocol streams, the target
+// address in SOCKS encoding as shadowsocks uses it, and the reply of the proxy
+// once it dialed the target, a handshake response frame.
+package connect
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// Header returns the header of a stream to target host:port.
+func Header(target string) ([]byte, error) {
+	addr := socks.ParseAddr(target)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid connect target [%s]", target)
+	}
+	return addr, nil
+}
+
+func WriteTarget(w io.Writer, target string) error {
+	header, err := Header(target)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(header)
+	return err
+}
+
+// ReadTarget reads the header of a stream and returns the target host:port.
+func ReadTarget(r io.Reader) (string, error) {
+	addr, err := socks.ReadAddr(r)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+// WriteReply writes the reply to the header, StatusOK once the target is connected.
+func WriteReply(w io.Writer, status handshake.Status, reason string) error {
+	return handshake.WriteResponse(w, &handshake.Response{Status: status, Reason: reason})
+}
+
+// ReadReply reads the reply to the header, and returns a *ReplyError unless the target is connected.
+func ReadReply(r io.Reader) error {
+	resp, err := handshake.ReadResponse(r)
+	if err != nil {
+		return err
+	}
+	if resp.Status == handshake.StatusOK {
+		return nil
+	}
+	return &ReplyError{Status: resp.Status, Reason: resp.Reason}
+}
+
+// ReplyError is a failure of the proxy to connect the target, unlike
+// a *handshake.RejectedError it says nothing about the proxy itself.
+type ReplyError struct {
+	Status handshake.Status
+
+	Reason string
+}
+
+func (e *ReplyError) Error() string {
+	if len(e.Reason) == 0 {
+		return fmt.Sprintf("connect target: %s", e.Status)
+	}
+	return fmt.Sprintf("connect target: %s, %s", e.Status, e.Reason)
+}
+
+// Unwrap returns protocol.ErrNotAllowed for targets the proxy denies, so clients are told natively.
+func (e *ReplyError) Unwrap() error {
+	if e.Status == handshake.StatusDenied {
+		return protocol.ErrNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package handshake implements the frames exchanged at the start of a stream of
+// a handshake protocol version, before the raw bytes of the proxied protocol.
+//
+// A frame is a version byte, a big endian uint16 body length and a JSON body.
+// The endpoint sends a Request, the proxy answers with a Response, and only
+// relays the stream to the service if the status is StatusOK.
+package handshake
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+)
+
+const (
+	// Version of the protocol ids carrying a handshake, peers not knowing
+	// it keep using the original ids without one
+	Version = "0.1.0"
+
+	frameVersion byte = 1
+
+	maxFrameSize = 16 << 10
+)
+
+// ID returns the handshake version of protocol p, e.g. /p2p-proxy/http/0.1.0 for /p2p-proxy/http/0.0.1.
+func ID(p protocol.Protocol) protocol.Protocol {
+	return protocol.Protocol(path.Join(path.Dir(string(p)), Version))
+}
+
+type Status uint8
+
+const (
+	StatusOK Status = iota
+
+	// the proxy serves too many streams
+	StatusOverloaded
+
+	// the endpoint peer is not allowed to use the proxy
+	StatusForbidden
+
+	// the token is missing, invalid or expired
+	StatusUnauthorized
+
+	// the proxy can not reach the destination, replied by services after a failed dial
+	StatusUnreachable
+
+	// the egress policy of the proxy denies the destination
+	StatusDenied
+
+	// the endpoint peer used up its quota
+	StatusQuotaExceeded
+
+	StatusBadRequest
+)
+
+var statusText = map[Status]string{
+	StatusOK:            "ok",
+	StatusOverloaded:    "overloaded",
+	StatusForbidden:     "forbidden",
+	StatusUnauthorized:  "unauthorized",
+	StatusUnreachable:   "unreachable",
+	StatusDenied:        "denied",
+	StatusQuotaExceeded: "quota exceeded",
+	StatusBadRequest:    "bad request",
+}
+
+func (s Status) String() string {
+	if text, ok := statusText[s]; ok {
+		return text
+	}
+	return fmt.Sprintf("status(%d)", uint8(s))
+}
+
+type Request struct {
+	// identifies the connection in the logs of both sides
+	TraceID string `json:"traceId,omitempty"`
+
+	Token string `json:"token,omitempty"`
+
+	// target host:port, if the endpoint knows it
+	Destination string `json:"destination,omitempty"`
+}
+
+type Response struct {
+	Status Status `json:"status"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+// Err returns a *RejectedError unless the status is StatusOK.
+func (r *Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return &RejectedError{Status: r.Status, Reason: r.Reason}
+}
+
+// RejectedError is the rejection of a stream by the proxy.
+type RejectedError struct {
+	Status Status
+
+	Reason string
+}
+
+// Reject returns the error an admission check rejects a stream with.
+func Reject(status Status, format string, args ...interface{}) *RejectedError {
+	return &RejectedError{Status: status, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *RejectedError) Error() string {
+	if len(e.Reason) == 0 {
+		return fmt.Sprintf("stream rejected: %s", e.Status)
+	}
+	return fmt.Sprintf("stream rejected: %s, %s", e.Status, e.Reason)
+}
+
+// Response returns the response reporting the rejection.
+func (e *RejectedError) Response() *Response {
+	return &Response{Status: e.Status, Reason: e.Reason}
+}
+
+func WriteRequest(w io.Writer, req *Request) error {
+	return writeFrame(w, req)
+}
+
+func ReadRequest(r io.Reader) (*Request, error) {
+	req := new(Request)
+	if err := readFrame(r, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func WriteResponse(w io.Writer, resp *Response) error {
+	return writeFrame(w, resp)
+}
+
+func ReadResponse(r io.Reader) (*Response, error) {
+	resp := new(Response)
+	if err := readFrame(r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func writeFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFrameSize {
+		return fmt.Errorf("handshake frame of %d bytes exceeds %d", len(body), maxFrameSize)
+	}
+	frame := make([]byte, 3+len(body))
+	frame[0] = frameVersion
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(body)))
+	copy(frame[3:], body)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}) error {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if header[0] != frameVersion {
+		return fmt.Errorf("unsupported handshake frame version %d", header[0])
+	}
+	size := binary.BigEndian.Uint16(header[1:3])
+	if size > maxFrameSize {
+		return fmt.Errorf("handshake frame of %d bytes exceeds %d", size, maxFrameSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import "strings"
+
+// prefixes of the username parts which are hints
+const (
+	hintPeer    = "peer-"
+	hintAlias   = "alias-"
+	hintPool    = "pool-"
+	hintSession = "session-"
+)
+
+// Hints select the proxy of a connection. Clients give them as '+' separated parts
+// of their proxy username, like 'alice+alias-tokyo1' or 'pool-eu+session-3'.
+type Hints struct {
+	// ID of the proxy peer to use
+	Peer string
+
+	// alias of the static proxy to use
+	Alias string
+
+	// proxy pool to pick from
+	Pool string
+
+	// connections of the same session stick to the same proxy
+	Session string
+}
+
+// IsZero reports whether no hint is given.
+func (h Hints) IsZero() bool {
+	return h == Hints{}
+}
+
+// ParseUsername splits the hints off username, and returns the remaining user.
+func ParseUsername(username string) (user string, hints Hints) {
+	var parts []string
+	for _, part := range strings.Split(username, "+") {
+		switch {
+		case strings.HasPrefix(part, hintPeer):
+			hints.Peer = part[len(hintPeer):]
+		case strings.HasPrefix(part, hintAlias):
+			hints.Alias = part[len(hintAlias):]
+		case strings.HasPrefix(part, hintPool):
+			hints.Pool = part[len(hintPool):]
+		case strings.HasPrefix(part, hintSession):
+			hints.Session = part[len(hintSession):]
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "+"), hints
+}
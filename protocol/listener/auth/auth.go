@@ -0,0 +1,141 @@
+// Package auth checks the credentials clients of the local listeners present, and
+// refuses listeners reachable from other hosts which do not require any.
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// keys of the 'Endpoint.ProxyProtocols' listener config
+const (
+	// list of 'user:password'
+	ConfigUsers = "Users"
+
+	// htpasswd style file of 'user:password' lines, the password
+	// either in plain text or as '{SHA}' base64 digest
+	ConfigHtpasswdFile = "HtpasswdFile"
+
+	// serve clients on non loopback addresses without authentication
+	ConfigAllowUnauthenticated = "AllowUnauthenticated"
+)
+
+const shaPrefix = "{SHA}"
+
+// Auth holds the accepted credentials, a nil *Auth accepts anyone.
+type Auth struct {
+	// password or '{SHA}' digest per user
+	users map[string]string
+}
+
+// FromConfig builds the Auth of a listener on listen, nil if no credentials are configured.
+// Listeners not on a loopback address must require authentication, unless the
+// config allows them not to, or authenticated says the protocol does itself.
+func FromConfig(listen string, cfg map[string]interface{}, authenticated bool) (*Auth, error) {
+	users := make(map[string]string)
+	if list, ok := cfg[ConfigUsers]; ok {
+		entries, ok := list.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' must be a list of 'user:password'", ConfigUsers)
+		}
+		for _, entry := range entries {
+			user, password, err := splitCredentials(fmt.Sprint(entry))
+			if err != nil {
+				return nil, err
+			}
+			users[user] = password
+		}
+	}
+	if file, ok := cfg[ConfigHtpasswdFile].(string); ok && len(file) > 0 {
+		if err := loadHtpasswd(file, users); err != nil {
+			return nil, err
+		}
+	}
+	if len(users) > 0 {
+		return &Auth{users: users}, nil
+	}
+	if allow, _ := cfg[ConfigAllowUnauthenticated].(bool); !allow && !authenticated && !isLoopback(listen) {
+		return nil, fmt.Errorf("listener on non loopback address [%s] requires '%s' or '%s', or '%s: true'",
+			listen, ConfigUsers, ConfigHtpasswdFile, ConfigAllowUnauthenticated)
+	}
+	return nil, nil
+}
+
+// Check reports whether the credentials are accepted.
+func (a *Auth) Check(user, password string) bool {
+	if a == nil {
+		return true
+	}
+	expected, ok := a.users[user]
+	if !ok {
+		// compare anyway, not to tell unknown users by timing
+		expected = shaPrefix
+	}
+	if strings.HasPrefix(expected, shaPrefix) {
+		sum := sha1.Sum([]byte(password))
+		password = shaPrefix + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 && ok
+}
+
+// Required reports whether clients must authenticate.
+func (a *Auth) Required() bool {
+	return a != nil
+}
+
+func loadHtpasswd(file string, users map[string]string) error {
+	file, err := homedir.Expand(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, err := splitCredentials(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		if strings.HasPrefix(password, "$") {
+			return fmt.Errorf("%s:%d: unsupported password hash of user [%s], use plain text or {SHA}", file, n, user)
+		}
+		users[user] = password
+	}
+	return scanner.Err()
+}
+
+func splitCredentials(s string) (user, password string, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid credentials, expect 'user:password'")
+	}
+	return s[:i], s[i+1:], nil
+}
+
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,207 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+)
+
+var errUnauthenticated = errors.New("proxy authentication failed")
+
+// TerminateHTTP reads the request of an HTTP proxy client. A CONNECT request is answered
+// once the tunnel is established, any other request is passed on in origin form
+// with 'Connection: close', since the next one may be for another host.
+func TerminateHTTP(a *auth.Auth) Handshake {
+	return func(c net.Conn) (*Conn, error) {
+		br := bufio.NewReader(c)
+		req, hints, err := readHTTPRequest(c, br, a)
+		if err != nil {
+			return nil, err
+		}
+		if req.Method == http.MethodConnect {
+			target := withPort(req.Host, "443")
+			conn := NewConn(c, br, protocol.Connect, target, replyConnect)
+			conn.hints = hints
+			return conn, nil
+		}
+
+		if req.URL.Scheme != "http" || len(req.URL.Host) == 0 {
+			writeStatus(c, http.StatusBadRequest)
+			return nil, fmt.Errorf("unsupported proxy request for [%s]", req.URL)
+		}
+		target := withPort(req.URL.Host, "80")
+		header, err := requestHeader(req, req.URL.RequestURI(), true)
+		if err != nil {
+			return nil, err
+		}
+		conn := NewConn(c, io.MultiReader(bytes.NewReader(header), br), protocol.Connect, target, replyRequest)
+		conn.hints = hints
+		return conn, nil
+	}
+}
+
+// RawHTTP reads the request of an HTTP proxy client to learn its target and check its
+// credentials, and passes it on to be relayed to the HTTP proxy service, without
+// 'Proxy-Authorization'. Requests other than CONNECT get 'Connection: close', since the
+// next ones would pass unchecked, and may be for another host. Terminated locally, the
+// connection is answered like those of TerminateHTTP.
+func RawHTTP(a *auth.Auth) Handshake {
+	return func(c net.Conn) (*Conn, error) {
+		br := bufio.NewReader(c)
+		var read bytes.Buffer
+		tr := bufio.NewReader(io.TeeReader(br, &read))
+		req, hints, err := readHTTPRequest(c, tr, a)
+		if err != nil {
+			return nil, err
+		}
+		target := req.Host
+		if req.Method != http.MethodConnect && len(req.URL.Host) > 0 {
+			target = req.URL.Host
+		}
+		if req.Method == http.MethodConnect {
+			target = withPort(target, "443")
+		} else {
+			target = withPort(target, "80")
+		}
+		// the bytes read ahead of the header end
+		peeked, _ := tr.Peek(tr.Buffered())
+		ahead := append([]byte(nil), peeked...)
+		local, err := localHTTP(c, req, target, ahead, br)
+		if err != nil {
+			return nil, err
+		}
+		local.hints = hints
+
+		var conn *Conn
+		tunnel := req.Method == http.MethodConnect
+		if tunnel && len(req.Header.Get("Proxy-Authorization")) == 0 {
+			conn = NewConn(c, io.MultiReader(&read, br), protocol.HTTP, target, nil)
+		} else {
+			header, err := requestHeader(req, req.RequestURI, !tunnel)
+			if err != nil {
+				return nil, err
+			}
+			r := io.MultiReader(bytes.NewReader(header), bytes.NewReader(ahead), br)
+			conn = NewConn(c, r, protocol.HTTP, target, nil)
+		}
+		conn.hints = hints
+		conn.local = local
+		return conn, nil
+	}
+}
+
+// localHTTP returns the connection of req terminated locally, which reads the bytes
+// read ahead of its header and the rest from br.
+func localHTTP(c net.Conn, req *http.Request, target string, ahead []byte, br io.Reader) (*Conn, error) {
+	if req.Method == http.MethodConnect {
+		return NewConn(c, io.MultiReader(bytes.NewReader(ahead), br), protocol.Connect, target, replyConnect), nil
+	}
+	header, err := requestHeader(req, req.URL.RequestURI(), true)
+	if err != nil {
+		return nil, err
+	}
+	r := io.MultiReader(bytes.NewReader(header), bytes.NewReader(ahead), br)
+	return NewConn(c, r, protocol.Connect, target, replyRequest), nil
+}
+
+// readHTTPRequest reads the request header and the hints of the 'Proxy-Authorization' user,
+// and answers it with 407 unless the client is authenticated.
+func readHTTPRequest(c net.Conn, br *bufio.Reader, a *auth.Auth) (*http.Request, protocol.Hints, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, protocol.Hints{}, err
+	}
+	username, password, ok := proxyBasicAuth(req)
+	user, hints := protocol.ParseUsername(username)
+	if a.Required() && (!ok || !a.Check(user, password)) {
+		io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"p2p-proxy\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, protocol.Hints{}, errUnauthenticated
+	}
+	return req, hints, nil
+}
+
+func proxyBasicAuth(req *http.Request) (user, password string, ok bool) {
+	const prefix = "Basic "
+	header := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(decoded)
+	i := strings.Index(credentials, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return credentials[:i], credentials[i+1:], true
+}
+
+// requestHeader returns the request line with uri and the header of req without the
+// proxy credentials, the body is left unread and follows as sent by the client,
+// chunked encoding included.
+func requestHeader(req *http.Request, uri string, closeConn bool) ([]byte, error) {
+	header := req.Header.Clone()
+	header.Del("Proxy-Authorization")
+	if closeConn {
+		header.Del("Proxy-Connection")
+		header.Set("Connection", "close")
+	}
+	if len(req.TransferEncoding) > 0 {
+		header.Set("Transfer-Encoding", req.TransferEncoding[0])
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/%d.%d\r\nHost: %s\r\n", req.Method, uri, req.ProtoMajor, req.ProtoMinor, req.Host)
+	if err := header.Write(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+func replyConnect(w io.Writer, err error) error {
+	if err != nil {
+		return writeStatus(w, errorStatus(err))
+	}
+	_, err = io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+// replyRequest only reports failures, otherwise the origin server responds.
+func replyRequest(w io.Writer, err error) error {
+	if err != nil {
+		return writeStatus(w, errorStatus(err))
+	}
+	return nil
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, protocol.ErrNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func writeStatus(w io.Writer, code int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
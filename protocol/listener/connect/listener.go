@@ -0,0 +1,194 @@
+// Package connect implements local listeners terminating HTTP proxy and SOCKS5 clients,
+// whose connections the endpoint relays through the Connect protocol.
+package connect
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/log"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+)
+
+// timeout of a client sending its request
+const handshakeTimeout = 30 * time.Second
+
+func init() {
+	listeners := []struct {
+		name      protocol.Protocol
+		short     string
+		handshake func(*auth.Auth) Handshake
+	}{
+		{protocol.ConnectHTTP, "connect-http", TerminateHTTP},
+		{protocol.ConnectSocks5, "connect-socks5", TerminateSocks5},
+	}
+	for _, l := range listeners {
+		err := protocol.RegisterLocalListenerFactory(l.name, l.short, NewFactory(l.handshake), protocol.Connect)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Handshake reads the request of a client, and returns the connection to relay.
+type Handshake func(c net.Conn) (*Conn, error)
+
+// NewFactory returns a factory of listeners running the handshake built with the
+// authentication of the listener config.
+func NewFactory(handshake func(*auth.Auth) Handshake) protocol.ListenerFactory {
+	return func(logger log.Logger, listen string, cfg map[string]interface{}) (protocol.Listener, error) {
+		a, err := auth.FromConfig(listen, cfg, false)
+		if err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("tcp", listen)
+		if err != nil {
+			return nil, err
+		}
+		return NewListener(logger, l, handshake(a)), nil
+	}
+}
+
+// NewListener returns a listener running handshake on the accepted connections concurrently,
+// so a slow client does not hold up the others.
+func NewListener(logger log.Logger, l net.Listener, handshake Handshake) protocol.Listener {
+	hl := &listener{
+		Listener:  l,
+		logger:    logger,
+		handshake: handshake,
+		ready:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go hl.acceptLoop()
+	return hl
+}
+
+type listener struct {
+	net.Listener
+
+	logger log.Logger
+
+	handshake Handshake
+
+	ready chan net.Conn
+
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	err error
+}
+
+func (l *listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			l.closeOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.serve(c)
+	}
+}
+
+func (l *listener) serve(c net.Conn) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, err := l.handshake(c)
+	if err != nil {
+		l.logger.Debugf("Handshake of [%s]: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	select {
+	case l.ready <- conn:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *listener) Protocol() protocol.Protocol {
+	return protocol.Connect
+}
+
+// Conn is a client connection whose request was read, implementing protocol.Conn.
+type Conn struct {
+	net.Conn
+
+	// reads what the client sent after its request
+	r io.Reader
+
+	protocol protocol.Protocol
+
+	target string
+
+	reply func(w io.Writer, err error) error
+
+	hints protocol.Hints
+
+	// count of the first bytes written which are dropped, answering what was answered locally already
+	skipWrite int
+
+	// the connection answering the client locally, nil if this one does
+	local *Conn
+}
+
+func NewConn(c net.Conn, r io.Reader, p protocol.Protocol, target string, reply func(w io.Writer, err error) error) *Conn {
+	return &Conn{Conn: c, r: r, protocol: p, target: target, reply: reply}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.skipWrite == 0 {
+		return c.Conn.Write(b)
+	}
+	skip := c.skipWrite
+	if skip > len(b) {
+		skip = len(b)
+	}
+	c.skipWrite -= skip
+	n, err := c.Conn.Write(b[skip:])
+	return n + skip, err
+}
+
+func (c *Conn) Protocol() protocol.Protocol {
+	return c.protocol
+}
+
+func (c *Conn) Target() string {
+	return c.target
+}
+
+func (c *Conn) Hints() protocol.Hints {
+	return c.hints
+}
+
+// Terminate returns the connection terminated locally, itself unless it is relayed in the client protocol.
+func (c *Conn) Terminate() protocol.Conn {
+	if c.local == nil {
+		return c
+	}
+	return c.local
+}
+
+func (c *Conn) Reply(err error) error {
+	if c.reply == nil {
+		return nil
+	}
+	return c.reply(c.Conn, err)
+}
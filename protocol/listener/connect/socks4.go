@@ -0,0 +1,103 @@
+package connect
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+)
+
+const (
+	socks4Version = 4
+
+	socks4CmdConnect = 1
+
+	socks4Granted byte = 0x5a
+
+	socks4Rejected byte = 0x5b
+
+	// longest user id or domain read
+	socks4MaxField = 255
+)
+
+// TerminateSocks4 reads the CONNECT request of a SOCKS4 or SOCKS4a client.
+// The reply is sent once the tunnel is established. SOCKS4 has no password,
+// so its clients are refused if a requires authentication.
+func TerminateSocks4(a *auth.Auth) Handshake {
+	return func(c net.Conn) (*Conn, error) {
+		return terminateSocks4(c, a)
+	}
+}
+
+func terminateSocks4(c net.Conn, a *auth.Auth) (*Conn, error) {
+	br := bufio.NewReader(c)
+
+	// VN CD DSTPORT DSTIP
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(br, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported socks version %d", request[0])
+	}
+	if a.Required() {
+		writeSocks4Reply(c, socks4Rejected)
+		return nil, errUnauthenticated
+	}
+	if request[1] != socks4CmdConnect {
+		writeSocks4Reply(c, socks4Rejected)
+		return nil, fmt.Errorf("unsupported socks4 command %d", request[1])
+	}
+	port := int(request[2])<<8 | int(request[3])
+	ip := net.IP(request[4:8])
+
+	// USERID, unused
+	if _, err := readNullTerminated(br); err != nil {
+		return nil, err
+	}
+	host := ip.String()
+	// SOCKS4a, 0.0.0.x with x != 0 is followed by the domain
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domain, err := readNullTerminated(br)
+		if err != nil {
+			return nil, err
+		}
+		host = domain
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+	return NewConn(c, br, protocol.Connect, target, replySocks4), nil
+}
+
+func replySocks4(w io.Writer, err error) error {
+	if err != nil {
+		return writeSocks4Reply(w, socks4Rejected)
+	}
+	return writeSocks4Reply(w, socks4Granted)
+}
+
+func writeSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func readNullTerminated(br *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) >= socks4MaxField {
+			return "", errors.New("socks4 field too long")
+		}
+		field = append(field, b)
+	}
+}
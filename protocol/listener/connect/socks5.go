@@ -0,0 +1,193 @@
+package connect
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+const (
+	socks5Version = 5
+
+	methodNoAuth byte = 0
+
+	methodUserPass byte = 2
+
+	methodNoAcceptable byte = 0xff
+
+	// version of the username/password sub-negotiation, RFC 1929
+	userPassVersion = 1
+)
+
+// TerminateSocks5 reads the CONNECT request of a SOCKS5 client, authenticating
+// it by username and password if a requires it. The reply is sent once the
+// tunnel is established.
+func TerminateSocks5(a *auth.Auth) Handshake {
+	return func(c net.Conn) (*Conn, error) {
+		br := bufio.NewReader(c)
+		hints, err := negotiateSocks5(c, br, a)
+		if err != nil {
+			return nil, err
+		}
+		target, err := readSocks5Request(c, br)
+		if err != nil {
+			return nil, err
+		}
+		conn := NewConn(c, br, protocol.Connect, target, replySocks5)
+		conn.hints = hints
+		return conn, nil
+	}
+}
+
+// RawSocks5 negotiates the authentication method with a SOCKS5 client itself, reads its
+// request to learn the target, and passes the request on to be relayed to the SOCKS5
+// proxy service, which negotiates no authentication with the endpoint instead.
+// Terminated locally, the connection replies to the request itself.
+func RawSocks5(a *auth.Auth) Handshake {
+	return func(c net.Conn) (*Conn, error) {
+		br := bufio.NewReader(c)
+		hints, err := negotiateSocks5(c, br, a)
+		if err != nil {
+			return nil, err
+		}
+		var request bytes.Buffer
+		tr := bufio.NewReader(io.TeeReader(br, &request))
+		target, err := readSocks5Request(c, tr)
+		if err != nil {
+			return nil, err
+		}
+		greeting := []byte{socks5Version, 1, methodNoAuth}
+		conn := NewConn(c, io.MultiReader(bytes.NewReader(greeting), &request, br), protocol.Socks5, target, nil)
+		// the method the service selects was negotiated with the client already
+		conn.skipWrite = 2
+		conn.hints = hints
+		// the bytes read ahead of the request end
+		ahead, _ := tr.Peek(tr.Buffered())
+		conn.local = NewConn(c, io.MultiReader(bytes.NewReader(append([]byte(nil), ahead...)), br), protocol.Connect, target, replySocks5)
+		conn.local.hints = hints
+		return conn, nil
+	}
+}
+
+// negotiateSocks5 selects the authentication method, and authenticates the client if a requires it.
+// Username and password are asked for whenever the client offers them, for the hints in the username.
+func negotiateSocks5(c net.Conn, br *bufio.Reader, a *auth.Auth) (protocol.Hints, error) {
+	// VER NMETHODS METHODS
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return protocol.Hints{}, err
+	}
+	if header[0] != socks5Version {
+		return protocol.Hints{}, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return protocol.Hints{}, err
+	}
+	method := methodNoAcceptable
+	if hasMethod(methods, methodUserPass) {
+		method = methodUserPass
+	} else if !a.Required() && hasMethod(methods, methodNoAuth) {
+		method = methodNoAuth
+	}
+	if method == methodNoAcceptable {
+		c.Write([]byte{socks5Version, methodNoAcceptable})
+		return protocol.Hints{}, errors.New("no acceptable socks authentication method")
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return protocol.Hints{}, err
+	}
+	if method != methodUserPass {
+		return protocol.Hints{}, nil
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	username, err := readUserPassField(br, true)
+	if err != nil {
+		return protocol.Hints{}, err
+	}
+	password, err := readUserPassField(br, false)
+	if err != nil {
+		return protocol.Hints{}, err
+	}
+	user, hints := protocol.ParseUsername(username)
+	if !a.Check(user, password) {
+		c.Write([]byte{userPassVersion, 1})
+		return protocol.Hints{}, errUnauthenticated
+	}
+	_, err = c.Write([]byte{userPassVersion, 0})
+	return hints, err
+}
+
+// readUserPassField reads a length prefixed field, preceded by the version if first.
+func readUserPassField(br *bufio.Reader, first bool) (string, error) {
+	if first {
+		version, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if version != userPassVersion {
+			return "", fmt.Errorf("unsupported socks username/password version %d", version)
+		}
+	}
+	size, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, size)
+	if _, err := io.ReadFull(br, field); err != nil {
+		return "", err
+	}
+	return string(field), nil
+}
+
+// readSocks5Request reads a CONNECT request and returns its target, other commands are refused.
+func readSocks5Request(c net.Conn, r io.Reader) (string, error) {
+	// VER CMD RSV DST.ADDR DST.PORT
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", err
+	}
+	addr, err := socks.ReadAddr(r)
+	if err != nil {
+		return "", err
+	}
+	if request[1] != socks.CmdConnect {
+		writeSocks5Reply(c, socks.ErrCommandNotSupported)
+		return "", fmt.Errorf("unsupported socks command %d", request[1])
+	}
+	return addr.String(), nil
+}
+
+func replySocks5(w io.Writer, err error) error {
+	if errors.Is(err, protocol.ErrNotAllowed) {
+		return writeSocks5Reply(w, socks.ErrConnectionNotAllowed)
+	}
+	if err != nil {
+		return writeSocks5Reply(w, socks.ErrGeneralFailure)
+	}
+	return writeSocks5Reply(w, 0)
+}
+
+// writeSocks5Reply writes a reply with the code and an empty IPv4 bind address.
+func writeSocks5Reply(w io.Writer, code socks.Error) error {
+	_, err := w.Write([]byte{socks5Version, byte(code), 0, socks.AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func hasMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+// Package mixed implements a local listener serving HTTP proxy, SOCKS4/4a and SOCKS5
+// clients on one port, telling them apart by the first bytes they send.
+package mixed
+
+import (
+	"bufio"
+	"io"
+	"net"
+
+	"github.com/diandianl/p2p-proxy/log"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+	"github.com/diandianl/p2p-proxy/protocol/listener/connect"
+)
+
+func init() {
+	err := protocol.RegisterLocalListenerFactory(protocol.Mixed, "mixed", New,
+		protocol.HTTP, protocol.Socks5, protocol.Connect)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func New(logger log.Logger, listen string, cfg map[string]interface{}) (protocol.Listener, error) {
+	a, err := auth.FromConfig(listen, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: connect.NewListener(logger, l, Sniff(a))}, nil
+}
+
+type listener struct {
+	protocol.Listener
+}
+
+// Protocol returns the protocol of HTTP clients, the connections of the others override it.
+func (l *listener) Protocol() protocol.Protocol {
+	return protocol.HTTP
+}
+
+// Sniff tells the client protocol by the first byte. SOCKS5 and HTTP are relayed
+// to the proxy services of the same protocol, their first request is read though,
+// for the target and hints, and to authenticate them if a requires it. SOCKS4/4a, which
+// no proxy service speaks, is terminated and relayed through the Connect protocol.
+func Sniff(a *auth.Auth) connect.Handshake {
+	rawHTTP, rawSocks5, socks4 := connect.RawHTTP(a), connect.RawSocks5(a), connect.TerminateSocks4(a)
+	return func(c net.Conn) (*connect.Conn, error) {
+		br := bufio.NewReader(c)
+		first, err := br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		buffered := &bufferedConn{Conn: c, r: br}
+		switch first[0] {
+		case 5:
+			return rawSocks5(buffered)
+		case 4:
+			return socks4(buffered)
+		default:
+			return rawHTTP(buffered)
+		}
+	}
+}
+
+// bufferedConn reads from the reader the first bytes were peeked with.
+type bufferedConn struct {
+	net.Conn
+
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
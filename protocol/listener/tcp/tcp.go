@@ -1,34 +1,47 @@
 package tcp
 
 import (
+	"net"
+
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/protocol"
-	"net"
+	"github.com/diandianl/p2p-proxy/protocol/listener/auth"
+	"github.com/diandianl/p2p-proxy/protocol/listener/connect"
 )
 
 func init() {
 	protos := []struct {
 		protocol protocol.Protocol
 		short    string
+		// reads the target and hints of clients and authenticates them before relaying
+		// them as sent, nil if the protocol authenticates itself
+		handshake func(*auth.Auth) connect.Handshake
 	}{
-		{protocol.HTTP, "http"},
-		{protocol.Socks5, "socks5"},
-		{protocol.Shadowsocks, "shadowsocks"},
+		{protocol.HTTP, "http", connect.RawHTTP},
+		{protocol.Socks5, "socks5", connect.RawSocks5},
+		{protocol.Shadowsocks, "shadowsocks", nil},
 	}
 	for _, proto := range protos {
-		err := protocol.RegisterListenerFactory(NewFactory(proto.protocol, proto.short))
+		err := protocol.RegisterListenerFactory(NewFactory(proto.protocol, proto.short, proto.handshake))
 		if err != nil {
 			panic(err)
 		}
 	}
 }
 
-func NewFactory(p protocol.Protocol, short string) (protocol.Protocol, string, func(logger log.Logger, listen string) (protocol.Listener, error)) {
-	return p, short, func(logger log.Logger, listen string) (protocol.Listener, error) {
+func NewFactory(p protocol.Protocol, short string, handshake func(*auth.Auth) connect.Handshake) (protocol.Protocol, string, protocol.ListenerFactory) {
+	return p, short, func(logger log.Logger, listen string, cfg map[string]interface{}) (protocol.Listener, error) {
+		a, err := auth.FromConfig(listen, cfg, handshake == nil)
+		if err != nil {
+			return nil, err
+		}
 		l, err := net.Listen("tcp", listen)
 		if err != nil {
 			return nil, err
 		}
+		if handshake != nil {
+			return &handshakeListener{protocol: p, Listener: connect.NewListener(logger, l, handshake(a))}, nil
+		}
 		return &listener{protocol: p, Listener: l}, nil
 	}
 }
@@ -42,3 +55,14 @@ type listener struct {
 func (l *listener) Protocol() protocol.Protocol {
 	return l.protocol
 }
+
+// handshakeListener accepts the connections of clients whose first request was read.
+type handshakeListener struct {
+	protocol protocol.Protocol
+
+	protocol.Listener
+}
+
+func (l *handshakeListener) Protocol() protocol.Protocol {
+	return l.protocol
+}
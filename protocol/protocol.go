@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,10 +16,32 @@ const (
 	Socks5 Protocol = "/p2p-proxy/socks5/0.0.1"
 
 	Shadowsocks Protocol = "/p2p-proxy/shadowsocks/0.0.1"
+
+	// streams start with the target address in SOCKS encoding, followed by the raw relay
+	Connect Protocol = "/p2p-proxy/connect/0.0.1"
+)
+
+// local listeners terminating the client protocol and relaying through Connect
+const (
+	ConnectHTTP Protocol = "/p2p-proxy/connect/0.0.1/http"
+
+	ConnectSocks5 Protocol = "/p2p-proxy/connect/0.0.1/socks5"
+
+	// one port for HTTP, SOCKS4/4a and SOCKS5 clients
+	Mixed Protocol = "/p2p-proxy/mixed/0.0.1"
 )
 
 type Protocol string
 
+// ErrNotAllowed is replied to clients whose connection is refused by the endpoint.
+var ErrNotAllowed = errors.New("connection not allowed by rules")
+
+// Rendezvous returns the discovery namespace under which proxies
+// serving protocol p advertise themselves.
+func Rendezvous(serviceTag string, p Protocol) string {
+	return serviceTag + string(p)
+}
+
 type Service interface {
 	Protocol() Protocol
 
@@ -37,13 +60,43 @@ type Listener interface {
 	Accept() (net.Conn, error)
 }
 
-type ListenerFactory func(logger log.Logger, listen string) (Listener, error)
+// Conn is implemented by connections of listeners which terminate the client protocol
+// themselves or serve several protocols, so they know how to relay each connection.
+type Conn interface {
+	net.Conn
+
+	// Protocol the connection is relayed with, overriding the one of its listener.
+	Protocol() Protocol
+
+	// Target returns the host:port the client asked for, empty if unknown.
+	Target() string
+
+	// Hints returns the proxy selection hints of the client username.
+	Hints() Hints
+
+	// Reply tells the client whether the connection to the target was established,
+	// a nil err is success. It is called once before relaying.
+	Reply(err error) error
+}
+
+// Terminator is implemented by connections relayed in their client protocol, whose request
+// the listener read already, so the endpoint can answer the client natively instead,
+// to dial the target directly or to refuse it.
+type Terminator interface {
+	// Terminate returns the connection terminated locally, which reads what the client
+	// sent after its request, and replies in the client protocol.
+	Terminate() Conn
+}
+
+type ListenerFactory func(logger log.Logger, listen string, cfg map[string]interface{}) (Listener, error)
 
 type metadata struct {
 	protocol   Protocol
 	short      string
 	svcFactory ServiceFactory
 	lsrFactory ListenerFactory
+	// protocols the streams of a listener are opened with
+	remotes []Protocol
 }
 
 var svcRegistry = map[Protocol]*metadata{}
@@ -81,11 +134,33 @@ func RegisterListenerFactory(protocol Protocol, short string, factory ListenerFa
 	if _, ok := lsrRegistry[protocol]; ok {
 		return fmt.Errorf("duplicate registration, Protocol [%s] Factory registered", protocol)
 	}
-	lsrRegistry[protocol] = &metadata{protocol: protocol, short: short, lsrFactory: factory}
+	lsrRegistry[protocol] = &metadata{protocol: protocol, short: short, lsrFactory: factory, remotes: []Protocol{protocol}}
+	return nil
+}
+
+// RegisterLocalListenerFactory registers a listener terminating the client protocol locally,
+// under a name which is no protocol served by proxies. Its connections are relayed with
+// the remote protocols, the first of them is the one the Listener reports.
+func RegisterLocalListenerFactory(name Protocol, short string, factory ListenerFactory, remotes ...Protocol) error {
+	if len(remotes) == 0 {
+		return fmt.Errorf("no remote protocol of listener [%s]", name)
+	}
+	if _, ok := lsrRegistry[name]; ok {
+		return fmt.Errorf("duplicate registration, Protocol [%s] Factory registered", name)
+	}
+	lsrRegistry[name] = &metadata{protocol: name, short: short, lsrFactory: factory, remotes: remotes}
 	return nil
 }
 
-func NewListener(protocol Protocol, listen string) (Listener, error) {
+// RemoteProtocols returns the protocols the connections of listener p are relayed with.
+func RemoteProtocols(p Protocol) []Protocol {
+	if m, ok := lsrRegistry[p]; ok {
+		return m.remotes
+	}
+	return []Protocol{p}
+}
+
+func NewListener(protocol Protocol, listen string, cfg map[string]interface{}) (Listener, error) {
 	m, ok := lsrRegistry[protocol]
 	if !ok {
 		if len(svcRegistry) == 0 {
@@ -94,12 +169,12 @@ func NewListener(protocol Protocol, listen string) (Listener, error) {
 		return nil, fmt.Errorf("unsupported Protocol [%s]", protocol)
 	}
 	logger := log.NewSubLogger(m.short)
-	s, err := m.lsrFactory(logger, listen)
+	s, err := m.lsrFactory(logger, listen, cfg)
 	if err != nil {
 		return nil, err
 	}
-	if protocol != s.Protocol() {
-		return nil, fmt.Errorf("mismatched protocol, expect [%s], got [%s]", protocol, s.Protocol())
+	if m.remotes[0] != s.Protocol() {
+		return nil, fmt.Errorf("mismatched protocol, expect [%s], got [%s]", m.remotes[0], s.Protocol())
 	}
 	return s, nil
 }
@@ -0,0 +1,119 @@
+package connect
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/log"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/connect"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+	"github.com/diandianl/p2p-proxy/protocol/service/egress"
+	"github.com/diandianl/p2p-proxy/relay"
+)
+
+// default of the 'DialTimeout' config
+const defaultDialTimeout = 10 * time.Second
+
+func init() {
+	err := protocol.RegisterServiceFactory(protocol.Connect, "connect", New)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func New(logger log.Logger, cfg map[string]interface{}) (protocol.Service, error) {
+	dialTimeout := defaultDialTimeout
+	if t, ok := cfg["DialTimeout"]; ok {
+		d, err := time.ParseDuration(t.(string))
+		if err != nil {
+			return nil, err
+		}
+		dialTimeout = d
+	}
+	policy, err := egress.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &connectService{
+		logger: logger,
+		dialer: &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second},
+		egress: policy,
+	}, nil
+}
+
+type connectService struct {
+	logger log.Logger
+
+	dialer *net.Dialer
+
+	egress *egress.Policy
+
+	listener net.Listener
+
+	shuttingDown bool
+}
+
+func (_ *connectService) Protocol() protocol.Protocol {
+	return protocol.Connect
+}
+
+func (s *connectService) Serve(ctx context.Context, l net.Listener) error {
+	s.listener = l
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return s.errorTriggeredByShutdown(err)
+		}
+		go s.handleConn(ctx, c)
+	}
+}
+
+func (s *connectService) handleConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	logger := s.logger
+
+	target, err := connect.ReadTarget(conn)
+	if err != nil {
+		if s.errorTriggeredByShutdown(err) != nil {
+			logger.Warn("Read target ", err)
+		}
+		return
+	}
+
+	rc, err := s.egress.DialContext(ctx, s.dialer, "tcp", target)
+	if err != nil {
+		logger.Warnf("dial to target [%s] %s", target, err)
+		status := handshake.StatusUnreachable
+		if egress.IsDenied(err) {
+			status = handshake.StatusDenied
+		}
+		connect.WriteReply(conn, status, err.Error())
+		return
+	}
+	if err := connect.WriteReply(conn, handshake.StatusOK, ""); err != nil {
+		rc.Close()
+		return
+	}
+
+	if err := relay.CloseAfterRelay(rc, conn); s.errorTriggeredByShutdown(err) != nil {
+		logger.Warn("Relay failure ", err)
+	}
+}
+
+func (s *connectService) errorTriggeredByShutdown(err error) error {
+	if s.shuttingDown {
+		return nil
+	}
+	return err
+}
+
+func (s *connectService) Shutdown(ctx context.Context) error {
+	s.shuttingDown = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
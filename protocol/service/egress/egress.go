@@ -0,0 +1,212 @@
+// Package egress implements the exit policy of proxy services, which decides the
+// targets they may dial. Targets are checked on the addresses their host resolves to,
+// and dialed on the checked addresses only, so a name can not rebind to a denied one.
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// keys of the 'Proxy.Protocols' service config, the ones absent are taken from 'Proxy.Egress'
+const (
+	// list of rules of permitted targets, once any is given all other targets are denied
+	ConfigAllow = "EgressAllow"
+
+	// list of rules of denied targets, taking precedence over 'EgressAllow'
+	ConfigDeny = "EgressDeny"
+
+	// dial loopback, link-local, private and other special addresses, which are
+	// otherwise denied unless permitted by an address rule of 'EgressAllow'
+	ConfigAllowPrivate = "EgressAllowPrivate"
+)
+
+// ErrDenied is wrapped by the errors of targets the policy denies.
+var ErrDenied = errors.New("target denied by exit policy")
+
+// ranges denied unless allowed explicitly
+var privateNets = parseNets(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // shared address space
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// Policy decides the targets services may dial, one without rules denies the private ranges only.
+type Policy struct {
+	allow []rule
+
+	deny []rule
+
+	allowPrivate bool
+
+	resolver *net.Resolver
+}
+
+// FromConfig builds the Policy of a service config.
+func FromConfig(cfg map[string]interface{}) (*Policy, error) {
+	allow, err := stringList(cfg, ConfigAllow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := stringList(cfg, ConfigDeny)
+	if err != nil {
+		return nil, err
+	}
+	allowPrivate, _ := cfg[ConfigAllowPrivate].(bool)
+	return New(allow, deny, allowPrivate)
+}
+
+// New builds a Policy of allow and deny rules. A rule is a host with an optional port,
+// the host either an IP address, a CIDR, a domain matching itself and its subdomains,
+// or '*' for any, the port either a number, a range like 8000-8080, or '*' for any,
+// e.g. 10.1.0.0/16, [2001:db8::]/32:443, example.com:80, *:25.
+func New(allow, deny []string, allowPrivate bool) (*Policy, error) {
+	p := &Policy{allowPrivate: allowPrivate, resolver: net.DefaultResolver}
+	var err error
+	if p.allow, err = parseRules(allow); err != nil {
+		return nil, fmt.Errorf("invalid '%s': %s", ConfigAllow, err)
+	}
+	if p.deny, err = parseRules(deny); err != nil {
+		return nil, fmt.Errorf("invalid '%s': %s", ConfigDeny, err)
+	}
+	return p, nil
+}
+
+// Check returns an error wrapping ErrDenied if the policy denies host, as the client
+// named it, at port, resolved to ip.
+func (p *Policy) Check(host string, ip net.IP, port int) error {
+	host = normalizeHost(host)
+	if matchAny(p.deny, host, ip, port) {
+		return p.denied(host, ip, port, "denied")
+	}
+	if !p.allowPrivate && isPrivate(ip) && !matchAddressRule(p.allow, ip, port) {
+		return p.denied(host, ip, port, "private address")
+	}
+	if len(p.allow) > 0 && !matchAny(p.allow, host, ip, port) {
+		return p.denied(host, ip, port, "not allowed")
+	}
+	return nil
+}
+
+func (p *Policy) denied(host string, ip net.IP, port int, reason string) error {
+	target := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	if len(host) > 0 && net.ParseIP(host) == nil {
+		target = fmt.Sprintf("%s (%s)", net.JoinHostPort(host, strconv.Itoa(port)), ip)
+	}
+	return fmt.Errorf("%w, %s: %s", ErrDenied, reason, target)
+}
+
+// Resolve resolves the host of target host:port, and returns the addresses the policy
+// permits. The error wraps ErrDenied if it denies all of them.
+func (p *Policy) Resolve(ctx context.Context, target string) ([]string, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		if port, err = p.resolver.LookupPort(ctx, "tcp", portStr); err != nil {
+			return nil, err
+		}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := p.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	var permitted []string
+	for _, ip := range ips {
+		if err = p.Check(host, ip, port); err == nil {
+			permitted = append(permitted, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+	if len(permitted) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no address of [%s]", host)
+		}
+		return nil, err
+	}
+	return permitted, nil
+}
+
+// DialContext dials target host:port with d, on the first of its addresses the policy permits
+// that accepts the connection. The error wraps ErrDenied if the policy denies the target.
+func (p *Policy) DialContext(ctx context.Context, d *net.Dialer, network, target string) (net.Conn, error) {
+	addrs, err := p.Resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// IsDenied reports whether err tells the policy denied a target.
+func IsDenied(err error) bool {
+	return errors.Is(err, ErrDenied)
+}
+
+func isPrivate(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringList(cfg map[string]interface{}, key string) ([]string, error) {
+	switch list := cfg[key].(type) {
+	case nil:
+		return nil, nil
+	case []string:
+		return list, nil
+	case []interface{}:
+		entries := make([]string, 0, len(list))
+		for _, entry := range list {
+			entries = append(entries, fmt.Sprint(entry))
+		}
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("'%s' must be a list of rules", key)
+	}
+}
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
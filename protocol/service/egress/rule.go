@@ -0,0 +1,150 @@
+package egress
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// rule matches targets by address or domain, and port. A rule without both matches any host.
+type rule struct {
+	network *net.IPNet
+
+	// lower case, without the trailing dot
+	domain string
+
+	// inclusive, zero minPort matches any port
+	minPort, maxPort int
+}
+
+func parseRules(entries []string) ([]rule, error) {
+	rules := make([]rule, 0, len(entries))
+	for _, entry := range entries {
+		r, err := parseRule(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(s string) (rule, error) {
+	var r rule
+	host, port := splitRule(s)
+	if len(host) == 0 {
+		return r, fmt.Errorf("no host in rule [%s]", s)
+	}
+	if err := r.parsePort(port); err != nil {
+		return r, fmt.Errorf("invalid port of rule [%s]: %s", s, err)
+	}
+	switch {
+	case host == "*":
+	case strings.Contains(host, "/"):
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return r, fmt.Errorf("invalid rule [%s]: %s", s, err)
+		}
+		r.network = n
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		r.domain = normalizeHost(strings.TrimPrefix(host, "*."))
+	}
+	return r, nil
+}
+
+// splitRule splits a rule into its host and port, the port is empty if there is none.
+func splitRule(s string) (string, string) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return s, ""
+		}
+		host, rest := s[1:end], s[end+1:]
+		// the prefix length of a CIDR follows the bracket
+		if strings.HasPrefix(rest, "/") {
+			i := strings.Index(rest, ":")
+			if i < 0 {
+				i = len(rest)
+			}
+			host, rest = host+rest[:i], rest[i:]
+		}
+		return host, strings.TrimPrefix(rest, ":")
+	}
+	// IPv6 addresses without brackets have no port
+	if strings.Count(s, ":") == 1 {
+		i := strings.Index(s, ":")
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func (r *rule) parsePort(s string) error {
+	if len(s) == 0 || s == "*" {
+		return nil
+	}
+	lower, upper := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lower, upper = s[:i], s[i+1:]
+	}
+	var err error
+	if r.minPort, err = strconv.Atoi(lower); err != nil {
+		return err
+	}
+	if r.maxPort, err = strconv.Atoi(upper); err != nil {
+		return err
+	}
+	if r.minPort < 1 || r.maxPort > 65535 || r.minPort > r.maxPort {
+		return fmt.Errorf("out of range [%s]", s)
+	}
+	return nil
+}
+
+func (r *rule) matchPort(port int) bool {
+	return r.minPort == 0 || (port >= r.minPort && port <= r.maxPort)
+}
+
+func (r *rule) match(host string, ip net.IP, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	switch {
+	case r.network != nil:
+		return r.network.Contains(ip)
+	case len(r.domain) > 0:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	default:
+		return true
+	}
+}
+
+func matchAny(rules []rule, host string, ip net.IP, port int) bool {
+	for i := range rules {
+		if rules[i].match(host, ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddressRule reports whether any rule with an address or CIDR matches ip at port,
+// rules of domains and any host do not permit private addresses.
+func matchAddressRule(rules []rule, ip net.IP, port int) bool {
+	for i := range rules {
+		if rules[i].network != nil && rules[i].match("", ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -2,11 +2,14 @@ package http
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/service/egress"
 
 	"github.com/elazarl/goproxy"
 )
@@ -25,6 +28,12 @@ func New(logger log.Logger, cfg map[string]interface{}) (protocol.Service, error
 
 	setLogger(proxy, logger)
 
+	policy, err := egress.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	applyEgress(proxy, policy)
+
 	return &goproxyService{logger: logger, srv: &http.Server{Handler: proxy}, delegate: proxy}, nil
 }
 
@@ -51,3 +60,57 @@ func (s *goproxyService) Serve(ctx context.Context, l net.Listener) error {
 func (s *goproxyService) Shutdown(ctx context.Context) error {
 	return s.srv.Shutdown(ctx)
 }
+
+// applyEgress makes proxy dial the targets policy permits only, and reply 403 Forbidden to
+// requests for denied ones. CONNECT requests for targets not resolved get 502 Bad Gateway.
+// Targets are dialed directly, not via the proxy of the environment.
+func applyEgress(proxy *goproxy.ProxyHttpServer, policy *egress.Policy) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	proxy.Tr.Proxy = nil
+	proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return policy.DialContext(ctx, dialer, network, addr)
+	}
+	// CONNECT targets are checked and resolved before dialing, to reply 403 instead of 502,
+	// so only the checked addresses are dialed, never names resolved again
+	proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%w, unchecked CONNECT target: %s", egress.ErrDenied, addr)
+		}
+		return dialer.Dial(network, addr)
+	}
+
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "80")
+		}
+		addrs, err := policy.Resolve(ctx.Req.Context(), host)
+		if egress.IsDenied(err) {
+			ctx.Warnf("Refuse CONNECT: %s", err)
+			ctx.Resp = errorResponse(ctx.Req, http.StatusForbidden, err)
+			return goproxy.RejectConnect, host
+		}
+		if err != nil {
+			ctx.Warnf("Resolve CONNECT target: %s", err)
+			ctx.Resp = errorResponse(ctx.Req, http.StatusBadGateway, err)
+			return goproxy.RejectConnect, host
+		}
+		// dial the checked address, the host may resolve to another one by now
+		return goproxy.OkConnect, addrs[0]
+	})
+
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil && egress.IsDenied(ctx.Error) {
+			ctx.Warnf("Refuse request: %s", ctx.Error)
+			return errorResponse(ctx.Req, http.StatusForbidden, ctx.Error)
+		}
+		return resp
+	})
+}
+
+func errorResponse(req *http.Request, status int, err error) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, err.Error())
+	// written as is to the hijacked connection of CONNECT requests
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	return resp
+}
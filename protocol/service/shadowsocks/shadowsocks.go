@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/service/egress"
 	"github.com/diandianl/p2p-proxy/relay"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"io"
@@ -40,7 +41,11 @@ func New(logger log.Logger, cfg map[string]interface{}) (protocol.Service, error
 	if err != nil {
 		return nil, err
 	}
-	return &shadowsocksService{logger: logger, shadow: cip.StreamConn}, nil
+	policy, err := egress.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksService{logger: logger, shadow: cip.StreamConn, egress: policy}, nil
 }
 
 type shadowsocksService struct {
@@ -48,6 +53,8 @@ type shadowsocksService struct {
 
 	shadow func(net.Conn) net.Conn
 
+	egress *egress.Policy
+
 	listener net.Listener
 
 	shuttingDown bool
@@ -64,11 +71,11 @@ func (s *shadowsocksService) Serve(ctx context.Context, l net.Listener) error {
 		if err != nil {
 			return s.errorTriggeredByShutdown(err)
 		}
-		go s.handleConn(c)
+		go s.handleConn(ctx, c)
 	}
 }
 
-func (s *shadowsocksService) handleConn(conn net.Conn) {
+func (s *shadowsocksService) handleConn(ctx context.Context, conn net.Conn) {
 
 	defer conn.Close()
 
@@ -83,7 +90,8 @@ func (s *shadowsocksService) handleConn(conn net.Conn) {
 		return
 	}
 
-	rc, err := net.Dial("tcp", tgt.String())
+	// shadowsocks has no reply, denied connections are closed like failed dials
+	rc, err := s.egress.DialContext(ctx, &net.Dialer{}, "tcp", tgt.String())
 	if err != nil {
 		logger.Warnf("dial to target [%s] ", tgt, err)
 		return
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/service/egress"
 	"net"
 
 	socks5 "github.com/armon/go-socks5"
@@ -18,8 +19,12 @@ func init() {
 
 func New(logger log.Logger, cfg map[string]interface{}) (protocol.Service, error) {
 
+	policy, err := egress.FromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 	// TODO process cfg
-	conf := &socks5.Config{}
+	conf := &socks5.Config{Rules: &egressRules{logger: logger, policy: policy}}
 	server, err := socks5.New(conf)
 	if err != nil {
 		return nil, err
@@ -50,6 +55,25 @@ func (s *socks5Service) Serve(ctx context.Context, l net.Listener) error {
 	return err
 }
 
+// egressRules permits the CONNECT commands to targets the exit policy permits, the server
+// resolves the target before, and replies 'connection not allowed by ruleset' to denied ones.
+type egressRules struct {
+	logger log.Logger
+
+	policy *egress.Policy
+}
+
+func (r *egressRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.Command != socks5.ConnectCommand {
+		return ctx, false
+	}
+	if err := r.policy.Check(req.DestAddr.FQDN, req.DestAddr.IP, req.DestAddr.Port); err != nil {
+		r.logger.Infof("Refuse [%s]: %s", req.RemoteAddr, err)
+		return ctx, false
+	}
+	return ctx, true
+}
+
 func (s *socks5Service) Shutdown(ctx context.Context) error {
 	s.shuttingDown = true
 	if s.listener != nil {
@@ -0,0 +1,129 @@
+// Package acl authorizes the endpoint peers opening streams to the proxy by their id.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/diandianl/p2p-proxy/config"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type peerSet map[peer.ID]struct{}
+
+// ACL is an access list of peer ids, see config.Access. It is safe for concurrent use.
+type ACL struct {
+	allow, deny peerSet
+
+	// resolved 'AllowFile', empty if none
+	file string
+
+	// peerSet of the allow file
+	fileAllow atomic.Value
+}
+
+// New builds the ACL of c, resolve resolves the path of its allow file.
+func New(c config.Access, resolve func(string) (string, error)) (*ACL, error) {
+	a := &ACL{}
+	var err error
+	if a.allow, err = parsePeers(c.Allow); err != nil {
+		return nil, fmt.Errorf("invalid 'Allow': %s", err)
+	}
+	if a.deny, err = parsePeers(c.Deny); err != nil {
+		return nil, fmt.Errorf("invalid 'Deny': %s", err)
+	}
+	if len(c.AllowFile) > 0 {
+		if a.file, err = resolve(c.AllowFile); err != nil {
+			return nil, err
+		}
+		if err := a.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Denied reports whether peer id is denied.
+func (a *ACL) Denied(id peer.ID) bool {
+	if a == nil {
+		return false
+	}
+	_, ok := a.deny[id]
+	return ok
+}
+
+// Allowed reports whether peer id may open streams. Denied peers never may, and once
+// any peer is allowed by the list or the file, the peers not allowed may not either.
+func (a *ACL) Allowed(id peer.ID) bool {
+	if a == nil {
+		return true
+	}
+	if a.Denied(id) {
+		return false
+	}
+	if len(a.allow) == 0 && len(a.file) == 0 {
+		return true
+	}
+	if _, ok := a.allow[id]; ok {
+		return true
+	}
+	fileAllow, _ := a.fileAllow.Load().(peerSet)
+	_, ok := fileAllow[id]
+	return ok
+}
+
+// File returns the resolved allow file, empty if none is configured.
+func (a *ACL) File() string {
+	return a.file
+}
+
+// Reload reads the allow file again, keeping the current peers if it is invalid.
+// A missing file allows no peer.
+func (a *ACL) Reload() error {
+	f, err := os.Open(a.file)
+	if os.IsNotExist(err) {
+		a.fileAllow.Store(peerSet{})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			ids = append(ids, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	peers, err := parsePeers(ids)
+	if err != nil {
+		return fmt.Errorf("%s: %s", a.file, err)
+	}
+	a.fileAllow.Store(peers)
+	return nil
+}
+
+func parsePeers(ids []string) (peerSet, error) {
+	peers := make(peerSet, len(ids))
+	for _, s := range ids {
+		id, err := peer.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer id [%s]: %s", s, err)
+		}
+		peers[id] = struct{}{}
+	}
+	return peers, nil
+}
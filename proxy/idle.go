@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+// idleListener hands a stream to the service only once its first byte arrived, so idle
+// streams kept open by endpoint pools hold no service resources, and those closed
+// without any data are dropped silently. Streams idle longer than timeout are reset.
+type idleListener struct {
+	net.Listener
+
+	timeout time.Duration
+
+	ready chan net.Conn
+
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	err error
+}
+
+func newIdleListener(l net.Listener, timeout time.Duration) *idleListener {
+	il := &idleListener{
+		Listener: l,
+		timeout:  timeout,
+		ready:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go il.acceptLoop()
+	return il
+}
+
+func (l *idleListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			l.closeOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.awaitData(c)
+	}
+}
+
+func (l *idleListener) awaitData(c net.Conn) {
+	if l.timeout > 0 {
+		c.SetReadDeadline(time.Now().Add(l.timeout))
+	}
+	r := bufio.NewReader(c)
+	if _, err := r.Peek(1); err != nil {
+		c.Close()
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	select {
+	case l.ready <- &peekedConn{Conn: c, r: r}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// peekedConn reads the bytes buffered while waiting for data first.
+type peekedConn struct {
+	net.Conn
+
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
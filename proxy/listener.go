@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/log"
+	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+	"github.com/diandianl/p2p-proxy/token"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/multierr"
+)
+
+// timeout of reading the handshake request and writing the response
+const handshakeTimeout = 10 * time.Second
+
+// streamInfo describes a stream waiting for admission.
+type streamInfo struct {
+	Remote peer.ID
+
+	Protocol protocol.Protocol
+
+	// nil if the stream uses the protocol version without handshake
+	Request *handshake.Request
+
+	// claims of the token of the request, nil if it presented none
+	Claims *token.Claims
+}
+
+// admitFunc decides whether a stream is served, a *handshake.RejectedError
+// reports the status to endpoints using the handshake version.
+type admitFunc func(info *streamInfo) error
+
+// wrapFunc wraps the conn of an admitted stream, to limit and count its traffic.
+type wrapFunc func(info *streamInfo, c net.Conn) net.Conn
+
+// serviceListener merges the streams of both versions of a service protocol, and
+// hands them to the service once the handshake, if any, and the admission succeeded.
+type serviceListener struct {
+	logger log.Logger
+
+	protocol protocol.Protocol
+
+	// listeners of the original protocol id and of its handshake version
+	legacy, versioned net.Listener
+
+	admit admitFunc
+
+	wrap wrapFunc
+
+	// concurrent streams served, unlimited if not positive
+	maxStreams int64
+
+	active int64
+
+	ready chan net.Conn
+
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func newServiceListener(logger log.Logger, p protocol.Protocol, legacy, versioned net.Listener,
+	admit admitFunc, wrap wrapFunc, maxStreams int) *serviceListener {
+	l := &serviceListener{
+		logger:     logger,
+		protocol:   p,
+		legacy:     legacy,
+		versioned:  versioned,
+		admit:      admit,
+		wrap:       wrap,
+		maxStreams: int64(maxStreams),
+		ready:      make(chan net.Conn),
+		done:       make(chan struct{}),
+	}
+	go l.acceptLoop(legacy, false)
+	go l.acceptLoop(versioned, true)
+	return l
+}
+
+func (l *serviceListener) acceptLoop(lsr net.Listener, versioned bool) {
+	for {
+		c, err := lsr.Accept()
+		if err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+			l.closeOnce.Do(func() { close(l.done) })
+			return
+		}
+		go l.handshake(c, versioned)
+	}
+}
+
+func (l *serviceListener) handshake(c net.Conn, versioned bool) {
+	remote, err := peer.Decode(c.RemoteAddr().String())
+	if err != nil {
+		l.logger.Warnf("Decode remote peer of stream [%s]: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	info := &streamInfo{Remote: remote, Protocol: l.protocol}
+	if versioned {
+		c.SetDeadline(time.Now().Add(handshakeTimeout))
+		if info.Request, err = handshake.ReadRequest(c); err != nil {
+			l.logger.Debugf("Read handshake of [%s]: %s", remote, err)
+			c.Close()
+			return
+		}
+	}
+
+	err = l.check(info)
+	// once admitted, closing the stream releases its admission whatever fails next
+	var admitted *admittedConn
+	if err == nil {
+		admitted = &admittedConn{Conn: c, release: func() { atomic.AddInt64(&l.active, -1) }}
+	}
+	if versioned {
+		resp := &handshake.Response{Status: handshake.StatusOK}
+		if rejected, ok := err.(*handshake.RejectedError); ok {
+			resp = rejected.Response()
+		} else if err != nil {
+			resp = &handshake.Response{Status: handshake.StatusForbidden}
+		}
+		if werr := handshake.WriteResponse(c, resp); werr != nil && err == nil {
+			err = werr
+		}
+		c.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		l.logger.Debugf("Reject stream of [%s]%s: %s", remote, traceOf(info), err)
+		if admitted != nil {
+			admitted.Close()
+		} else {
+			c.Close()
+		}
+		return
+	}
+
+	var conn net.Conn = admitted
+	if l.wrap != nil {
+		conn = l.wrap(info, conn)
+	}
+	select {
+	case l.ready <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// check admits the stream, counting it as active if it is.
+func (l *serviceListener) check(info *streamInfo) error {
+	if l.admit != nil {
+		if err := l.admit(info); err != nil {
+			return err
+		}
+	}
+	if active := atomic.AddInt64(&l.active, 1); l.maxStreams > 0 && active > l.maxStreams {
+		atomic.AddInt64(&l.active, -1)
+		return handshake.Reject(handshake.StatusOverloaded, "serving %d streams", l.maxStreams)
+	}
+	return nil
+}
+
+func (l *serviceListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+func (l *serviceListener) Close() error {
+	return multierr.Combine(l.legacy.Close(), l.versioned.Close())
+}
+
+func (l *serviceListener) Addr() net.Addr {
+	return l.legacy.Addr()
+}
+
+func traceOf(info *streamInfo) string {
+	if info.Request == nil || len(info.Request.TraceID) == 0 {
+		return ""
+	}
+	return ", trace " + info.Request.TraceID
+}
+
+// admittedConn releases its admission once closed.
+type admittedConn struct {
+	net.Conn
+
+	once sync.Once
+
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
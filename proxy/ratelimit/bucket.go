@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes, whose limit may change while streams use it.
+// Takers may go into debt, and wait until it is paid back.
+type Bucket struct {
+	mu sync.Mutex
+
+	// bytes per second, zero is unlimited
+	rate float64
+
+	burst float64
+
+	tokens float64
+
+	last time.Time
+}
+
+func newBucket(rate, burst int64) *Bucket {
+	b := &Bucket{}
+	b.SetLimit(rate, burst)
+	return b
+}
+
+// SetLimit changes the rate in bytes per second, zero is unlimited, and the burst,
+// one second of rate if not positive.
+func (b *Bucket) SetLimit(rate, burst int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.advance(now)
+	if burst <= 0 {
+		burst = rate
+	}
+	if b.rate == 0 {
+		// start full, rather than with what was taken while unlimited
+		b.tokens = float64(burst)
+	}
+	b.rate, b.burst, b.last = float64(rate), float64(burst), now
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// take removes n tokens, and returns how long the taker waits until the bucket is out of debt.
+func (b *Bucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.advance(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) advance(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// bytes read or written between waits, so a stream does not run far into debt at once
+const chunkSize = 16 << 10
+
+// conn reads the uploads and writes the downloads of a stream at the rates of its leases.
+type conn struct {
+	net.Conn
+
+	upload, download []*Bucket
+
+	leases []*Lease
+
+	closed chan struct{}
+
+	once sync.Once
+}
+
+// NewConn limits c by the buckets of leases, which are released once it is closed.
+func NewConn(c net.Conn, leases ...*Lease) net.Conn {
+	lc := &conn{Conn: c, leases: leases, closed: make(chan struct{})}
+	for _, l := range leases {
+		lc.upload = append(lc.upload, l.upload...)
+		lc.download = append(lc.download, l.download...)
+	}
+	return lc
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(b) > chunkSize {
+		b = b[:chunkSize]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(c.upload, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := c.wait(c.download, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// wait takes n bytes from buckets, and waits until all of them are out of debt.
+func (c *conn) wait(buckets []*Bucket, n int) error {
+	var delay time.Duration
+	for _, b := range buckets {
+		if d := b.take(n); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		for _, l := range c.leases {
+			l.release()
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,166 @@
+// Package ratelimit limits the bandwidth of proxy streams, globally and per endpoint peer,
+// with token buckets whose limits can change while streams use them.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/diandianl/p2p-proxy/config"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// rates of a config.Bandwidth in bytes per second, zero is unlimited
+type rates struct {
+	upload, uploadBurst, download, downloadBurst int64
+}
+
+type limits struct {
+	global rates
+
+	perPeer rates
+
+	classes map[string]rates
+}
+
+// pair of the buckets of both directions
+type pair struct {
+	upload, download *Bucket
+}
+
+func newPair(r rates) *pair {
+	return &pair{upload: newBucket(r.upload, r.uploadBurst), download: newBucket(r.download, r.downloadBurst)}
+}
+
+func (p *pair) set(r rates) {
+	p.upload.SetLimit(r.upload, r.uploadBurst)
+	p.download.SetLimit(r.download, r.downloadBurst)
+}
+
+// the buckets of a peer, kept while it has streams
+type peerBuckets struct {
+	*pair
+
+	class string
+
+	streams int
+}
+
+// Limiter hands out the buckets of streams by the rates of a config.RateLimit.
+type Limiter struct {
+	mu sync.Mutex
+
+	limits limits
+
+	global *pair
+
+	peers map[peer.ID]*peerBuckets
+}
+
+// New builds the Limiter of c.
+func New(c config.RateLimit) (*Limiter, error) {
+	ls, err := parseLimits(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Limiter{limits: ls, global: newPair(ls.global), peers: make(map[peer.ID]*peerBuckets)}, nil
+}
+
+// Update applies the rates of c to the buckets of existing and future streams.
+func (l *Limiter) Update(c config.RateLimit) error {
+	ls, err := parseLimits(c)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = ls
+	l.global.set(ls.global)
+	for _, pb := range l.peers {
+		pb.set(ls.peer(pb.class))
+	}
+	return nil
+}
+
+// Acquire returns the lease of the buckets of a stream of peer p, whose token has the
+// bandwidth class, empty if none. The lease must be released once the stream is closed.
+func (l *Limiter) Acquire(p peer.ID, class string) *Lease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pb, ok := l.peers[p]
+	if !ok {
+		pb = &peerBuckets{pair: newPair(l.limits.peer(class)), class: class}
+		l.peers[p] = pb
+	} else if pb.class != class {
+		// the latest token of the peer decides its class
+		pb.class = class
+		pb.set(l.limits.peer(class))
+	}
+	pb.streams++
+	return &Lease{
+		upload:   []*Bucket{l.global.upload, pb.upload},
+		download: []*Bucket{l.global.download, pb.download},
+		release:  func() { l.release(p) },
+	}
+}
+
+func (l *Limiter) release(p peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pb, ok := l.peers[p]; ok {
+		if pb.streams--; pb.streams <= 0 {
+			delete(l.peers, p)
+		}
+	}
+}
+
+// Lease holds the buckets a stream takes from.
+type Lease struct {
+	upload, download []*Bucket
+
+	release func()
+}
+
+func (ls limits) peer(class string) rates {
+	if r, ok := ls.classes[class]; ok && len(class) > 0 {
+		return r
+	}
+	return ls.perPeer
+}
+
+func parseLimits(c config.RateLimit) (limits, error) {
+	ls := limits{classes: make(map[string]rates, len(c.Classes))}
+	var err error
+	if ls.global, err = parseRates(c.Global); err != nil {
+		return ls, fmt.Errorf("invalid 'Global': %s", err)
+	}
+	if ls.perPeer, err = parseRates(c.PerPeer); err != nil {
+		return ls, fmt.Errorf("invalid 'PerPeer': %s", err)
+	}
+	for class, b := range c.Classes {
+		r, err := parseRates(b)
+		if err != nil {
+			return ls, fmt.Errorf("invalid class [%s]: %s", class, err)
+		}
+		ls.classes[class] = r
+	}
+	return ls, nil
+}
+
+func parseRates(b config.Bandwidth) (r rates, err error) {
+	for _, f := range []struct {
+		size string
+		dst  *int64
+	}{
+		{b.Upload, &r.upload},
+		{b.UploadBurst, &r.uploadBurst},
+		{b.Download, &r.download},
+		{b.DownloadBurst, &r.downloadBurst},
+	} {
+		if *f.dst, err = config.ParseSize(f.size); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
@@ -3,11 +3,20 @@ package proxy
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
+	"time"
 
 	cfg "github.com/diandianl/p2p-proxy/config"
 	"github.com/diandianl/p2p-proxy/log"
 	"github.com/diandianl/p2p-proxy/p2p"
 	"github.com/diandianl/p2p-proxy/protocol"
+	"github.com/diandianl/p2p-proxy/protocol/handshake"
+	"github.com/diandianl/p2p-proxy/protocol/service/egress"
+	"github.com/diandianl/p2p-proxy/proxy/acl"
+	"github.com/diandianl/p2p-proxy/proxy/ratelimit"
+	"github.com/diandianl/p2p-proxy/proxy/usage"
+	"github.com/diandianl/p2p-proxy/token"
 
 	"github.com/libp2p/go-libp2p-core/discovery"
 	"github.com/libp2p/go-libp2p-core/host"
@@ -17,6 +26,9 @@ import (
 	"go.uber.org/multierr"
 )
 
+// interval of checking the allow files of 'Proxy.Access' and the token revocation file for changes
+const accessWatchInterval = 5 * time.Second
+
 type ProxyServer interface {
 	Start(ctx context.Context) error
 
@@ -38,6 +50,20 @@ type proxyServer struct {
 	node host.Host
 
 	services []protocol.Service
+
+	// 'Proxy.Access'
+	access *acl.ACL
+
+	tokens *token.Verifier
+
+	// 'Proxy.RateLimit'
+	limiter *ratelimit.Limiter
+
+	// the 'RateLimit' of each protocol
+	limiters map[protocol.Protocol]*ratelimit.Limiter
+
+	// nil if 'Proxy.Usage.Ledger' is empty
+	ledger *usage.Ledger
 }
 
 func (s *proxyServer) Start(ctx context.Context) error {
@@ -53,6 +79,31 @@ func (s *proxyServer) Start(ctx context.Context) error {
 		return errors.New("'Config.Proxy.Protocols' can not be empty")
 	}
 
+	access, err := s.newACL(ctx, c.Proxy.Access)
+	if err != nil {
+		return fmt.Errorf("invalid 'Proxy.Access': %s", err)
+	}
+	s.access = access
+
+	if s.tokens, err = s.newVerifier(ctx, c.Proxy.Tokens); err != nil {
+		return fmt.Errorf("invalid 'Proxy.Tokens': %s", err)
+	}
+
+	if s.limiter, err = ratelimit.New(c.Proxy.RateLimit); err != nil {
+		return fmt.Errorf("invalid 'Proxy.RateLimit': %s", err)
+	}
+	s.limiters = make(map[protocol.Protocol]*ratelimit.Limiter)
+
+	if s.ledger, err = usage.Open(c.Proxy.Usage, c.ResolvePath); err != nil {
+		return fmt.Errorf("invalid 'Proxy.Usage': %s", err)
+	}
+	if s.ledger != nil {
+		logger.Infof("Counting usage in %s", s.ledger.Path())
+		go s.ledger.Run(ctx, c.Proxy.Usage.FlushInterval, func(err error) {
+			s.logger.Warn("Save usage ledger: ", err)
+		})
+	}
+
 	h, rd, err := p2p.NewHostAndDiscovererAndBootstrap(ctx, c)
 	if err != nil {
 		return err
@@ -60,40 +111,208 @@ func (s *proxyServer) Start(ctx context.Context) error {
 	s.node = h
 
 	for _, proto := range c.Proxy.Protocols {
-		svc, err := protocol.NewService(protocol.Protocol(proto.Protocol), proto.Config)
+		svc, err := protocol.NewService(protocol.Protocol(proto.Protocol), s.serviceConfig(proto.Config))
 		if err != nil {
 			return err
 		}
+		access, err := s.newACL(ctx, proto.Access)
+		if err != nil {
+			return fmt.Errorf("invalid 'Access' of protocol [%s]: %s", proto.Protocol, err)
+		}
+		limiter, err := ratelimit.New(proto.RateLimit)
+		if err != nil {
+			return fmt.Errorf("invalid 'RateLimit' of protocol [%s]: %s", proto.Protocol, err)
+		}
+		s.limiters[svc.Protocol()] = limiter
 		s.services = append(s.services, svc)
 		logger.Infof("Supporting %s service", svc.Protocol())
 		go func() {
-			err := s.startService(ctx, svc)
+			err := s.startService(ctx, svc, s.admit(access), s.wrap(limiter))
 			if err != nil {
 				s.logger.Errorf("start proxy service [%s], ", svc.Protocol(), err)
 			}
 		}()
 	}
 
-	discovery2.Advertise(ctx, rd, c.ServiceTag, discovery.TTL(c.Proxy.ServiceAdvertiseInterval))
+	if len(c.Path()) > 0 {
+		go cfg.WatchFile(ctx, c.Path(), accessWatchInterval, s.reloadRateLimits)
+	}
+
+	ttl := discovery.TTL(c.Proxy.ServiceAdvertiseInterval)
+	// the service tag is still advertised for endpoints unaware of per protocol discovery
+	discovery2.Advertise(ctx, rd, c.ServiceTag, ttl)
+	for _, svc := range s.services {
+		discovery2.Advertise(ctx, rd, protocol.Rendezvous(c.ServiceTag, svc.Protocol()), ttl)
+	}
 
 	<-ctx.Done()
 	return s.Stop()
 }
 
-func (s *proxyServer) startService(ctx context.Context, svc protocol.Service) error {
-	l, err := gostream.Listen(s.node, p2pproto.ID(svc.Protocol()))
+func (s *proxyServer) startService(ctx context.Context, svc protocol.Service, admit admitFunc, wrap wrapFunc) error {
+	legacy, err := gostream.Listen(s.node, p2pproto.ID(svc.Protocol()))
+	if err != nil {
+		return err
+	}
+	versioned, err := gostream.Listen(s.node, p2pproto.ID(handshake.ID(svc.Protocol())))
 	if err != nil {
+		legacy.Close()
 		return err
 	}
+	timeout := s.cfg.Proxy.IdleStreamTimeout
+	l := newServiceListener(s.logger, svc.Protocol(),
+		newIdleListener(legacy, timeout), newIdleListener(versioned, timeout), admit, wrap, s.cfg.Proxy.MaxStreams)
 	return svc.Serve(ctx, l)
 }
 
+// serviceConfig returns a copy of the config of a service, with the exit policy
+// keys it does not set taken from 'Proxy.Egress'.
+func (s *proxyServer) serviceConfig(cfg map[string]interface{}) map[string]interface{} {
+	resolved := make(map[string]interface{}, len(cfg)+3)
+	for k, v := range cfg {
+		resolved[k] = v
+	}
+	global := s.cfg.Proxy.Egress
+	for k, v := range map[string]interface{}{
+		egress.ConfigAllow:        global.Allow,
+		egress.ConfigDeny:         global.Deny,
+		egress.ConfigAllowPrivate: global.AllowPrivate,
+	} {
+		if _, ok := resolved[k]; !ok {
+			resolved[k] = v
+		}
+	}
+	return resolved
+}
+
+// newACL builds the ACL of c, and reloads its allow file on change until ctx is done.
+func (s *proxyServer) newACL(ctx context.Context, c cfg.Access) (*acl.ACL, error) {
+	a, err := acl.New(c, s.cfg.ResolvePath)
+	if err != nil || len(a.File()) == 0 {
+		return a, err
+	}
+	go cfg.WatchFile(ctx, a.File(), accessWatchInterval, func() {
+		if err := a.Reload(); err != nil {
+			s.logger.Warn("Reload peer allow file, keep the current peers: ", err)
+			return
+		}
+		s.logger.Infof("Reloaded peer allow file %s", a.File())
+	})
+	return a, nil
+}
+
+// newVerifier builds the token verifier of c, and reloads its revocation file on change until ctx is done.
+func (s *proxyServer) newVerifier(ctx context.Context, c cfg.Tokens) (*token.Verifier, error) {
+	if c.Require && len(c.OperatorKeys) == 0 {
+		return nil, errors.New("'Require' needs 'OperatorKeys'")
+	}
+	var file string
+	if len(c.RevocationFile) > 0 {
+		var err error
+		if file, err = s.cfg.ResolvePath(c.RevocationFile); err != nil {
+			return nil, err
+		}
+	}
+	v, err := token.NewVerifier(c.OperatorKeys, file)
+	if err != nil || len(file) == 0 {
+		return v, err
+	}
+	go cfg.WatchFile(ctx, file, accessWatchInterval, func() {
+		if err := v.Reload(); err != nil {
+			s.logger.Warn("Reload token revocation file, keep the current revocations: ", err)
+			return
+		}
+		s.logger.Infof("Reloaded token revocation file %s", file)
+	})
+	return v, nil
+}
+
+// admit refuses the streams of peers not authorized, or over their quota.
+func (s *proxyServer) admit(access *acl.ACL) admitFunc {
+	return func(info *streamInfo) error {
+		if err := s.authorize(access, info); err != nil {
+			return err
+		}
+		if err := s.ledger.Check(info.Remote, classOf(info)); err != nil {
+			return handshake.Reject(handshake.StatusQuotaExceeded, "%s", err)
+		}
+		return nil
+	}
+}
+
+// authorize refuses the streams of peers denied by 'Proxy.Access' or the protocol access. Peers
+// presenting a token to a proxy with operator keys must present a valid one, which admits
+// them in place of the allow lists.
+func (s *proxyServer) authorize(access *acl.ACL, info *streamInfo) error {
+	if s.access.Denied(info.Remote) || access.Denied(info.Remote) {
+		return handshake.Reject(handshake.StatusForbidden, "peer denied")
+	}
+	// proxies without operator keys do not use tokens, and ignore the ones presented
+	if info.Request != nil && len(info.Request.Token) > 0 && len(s.cfg.Proxy.Tokens.OperatorKeys) > 0 {
+		claims, err := s.tokens.Verify(info.Request.Token, info.Remote, string(info.Protocol))
+		if err != nil {
+			return handshake.Reject(handshake.StatusUnauthorized, "%s", err)
+		}
+		info.Claims = claims
+		return nil
+	}
+	if s.cfg.Proxy.Tokens.Require {
+		return handshake.Reject(handshake.StatusUnauthorized, "token required")
+	}
+	if !s.access.Allowed(info.Remote) || !access.Allowed(info.Remote) {
+		return handshake.Reject(handshake.StatusForbidden, "peer not allowed")
+	}
+	return nil
+}
+
+// wrap counts the traffic of the streams in the ledger, and makes them take from the buckets of
+// 'Proxy.RateLimit' and limiter of their protocol, per peer by the bandwidth class of its token.
+func (s *proxyServer) wrap(limiter *ratelimit.Limiter) wrapFunc {
+	return func(info *streamInfo, c net.Conn) net.Conn {
+		class := classOf(info)
+		c = s.ledger.Track(info.Remote, info.Protocol, c)
+		return ratelimit.NewConn(c, s.limiter.Acquire(info.Remote, class), limiter.Acquire(info.Remote, class))
+	}
+}
+
+// classOf returns the bandwidth class of the token of a stream, empty if none.
+func classOf(info *streamInfo) string {
+	if info.Claims == nil {
+		return ""
+	}
+	return info.Claims.Class
+}
+
+// reloadRateLimits applies the rate limits of the changed config file to all streams.
+func (s *proxyServer) reloadRateLimits() {
+	c, err := s.cfg.Reload()
+	if err != nil {
+		s.logger.Warn("Reload config file, keep the current rate limits: ", err)
+		return
+	}
+	if err := s.limiter.Update(c.Proxy.RateLimit); err != nil {
+		s.logger.Warn("Invalid 'Proxy.RateLimit', keep the current one: ", err)
+		return
+	}
+	for _, proto := range c.Proxy.Protocols {
+		limiter, ok := s.limiters[protocol.Protocol(proto.Protocol)]
+		if !ok {
+			continue
+		}
+		if err := limiter.Update(proto.RateLimit); err != nil {
+			s.logger.Warnf("Invalid 'RateLimit' of protocol [%s], keep the current one: %s", proto.Protocol, err)
+		}
+	}
+	s.logger.Info("Reloaded rate limits")
+}
+
 func (s *proxyServer) Stop() error {
 	ctx := context.Background()
-	errs := make([]error, 0, len(s.services)+1)
+	errs := make([]error, 0, len(s.services)+2)
 	for _, svc := range s.services {
 		errs = append(errs, svc.Shutdown(ctx))
 	}
+	errs = append(errs, s.ledger.Flush())
 	errs = append(errs, s.node.Close())
 	return multierr.Combine(errs...)
 }
@@ -0,0 +1,259 @@
+package usage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+// key namespaces of the periods records are rolled up per
+const (
+	Day = "day"
+
+	Month = "month"
+)
+
+const (
+	dayLayout = "2006-01-02"
+
+	monthLayout = "2006-01"
+)
+
+const (
+	// timeout of waiting for another process to close the ledger
+	openTimeout = 10 * time.Second
+
+	openRetryInterval = 50 * time.Millisecond
+)
+
+// Usage is the traffic of a peer, in and out are the bytes it sent and received.
+type Usage struct {
+	BytesIn int64 `json:"in"`
+
+	BytesOut int64 `json:"out"`
+
+	Streams int64 `json:"streams"`
+}
+
+// Bytes returns the bytes in and out, which quotas limit.
+func (u Usage) Bytes() int64 {
+	return u.BytesIn + u.BytesOut
+}
+
+func (u *Usage) add(o Usage) {
+	u.BytesIn += o.BytesIn
+	u.BytesOut += o.BytesOut
+	u.Streams += o.Streams
+}
+
+// Record is the usage of a peer over a protocol in a day or month.
+type Record struct {
+	// Day or Month
+	Kind string
+
+	// like 2006-01-02 for days and 2006-01 for months
+	Period string
+
+	Peer string
+
+	Protocol string
+
+	Usage
+}
+
+// Periods returns the day and month of t.
+func Periods(t time.Time) (day, month string) {
+	return t.Format(dayLayout), t.Format(monthLayout)
+}
+
+// PeriodKind tells whether period is a day or a month.
+func PeriodKind(period string) (string, error) {
+	if _, err := time.Parse(dayLayout, period); err == nil {
+		return Day, nil
+	}
+	if _, err := time.Parse(monthLayout, period); err == nil {
+		return Month, nil
+	}
+	return "", fmt.Errorf("invalid period [%s], neither 2006-01-02 nor 2006-01", period)
+}
+
+// recordKey returns the key of the record of peer over protocol in period, protocols are escaped as they contain '/'.
+func recordKey(kind, period, peer, protocol string) ds.Key {
+	return ds.KeyWithNamespaces([]string{kind, period, peer, url.PathEscape(protocol)})
+}
+
+func parseRecord(e query.Entry) (Record, error) {
+	var r Record
+	parts := ds.RawKey(e.Key).Namespaces()
+	if len(parts) != 4 {
+		return r, fmt.Errorf("invalid ledger key [%s]", e.Key)
+	}
+	protocol, err := url.PathUnescape(parts[3])
+	if err != nil {
+		return r, fmt.Errorf("invalid ledger key [%s]: %s", e.Key, err)
+	}
+	r.Kind, r.Period, r.Peer, r.Protocol = parts[0], parts[1], parts[2], protocol
+	if err := json.Unmarshal(e.Value, &r.Usage); err != nil {
+		return r, fmt.Errorf("invalid ledger record [%s]: %s", e.Key, err)
+	}
+	return r, nil
+}
+
+// records returns the records of store under prefix, sorted by key.
+func records(store ds.Read, prefix string) ([]Record, error) {
+	results, err := store.Query(query.Query{Prefix: prefix, Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, err
+	}
+	rs := make([]Record, 0, len(entries))
+	for _, e := range entries {
+		r, err := parseRecord(e)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// addUsage adds u to the record of key.
+func addUsage(txn ds.Txn, key ds.Key, u Usage) error {
+	var total Usage
+	value, err := txn.Get(key)
+	switch err {
+	case nil:
+		if err := json.Unmarshal(value, &total); err != nil {
+			return fmt.Errorf("invalid ledger record [%s]: %s", key, err)
+		}
+	case ds.ErrNotFound:
+	default:
+		return err
+	}
+	total.add(u)
+	if value, err = json.Marshal(&total); err != nil {
+		return err
+	}
+	return txn.Put(key, value)
+}
+
+// prune deletes the records of days before day and of months before month,
+// none of a kind if its period is empty, and returns how many it deleted.
+func prune(txn ds.Txn, day, month string) (int, error) {
+	deleted := 0
+	for _, kind := range []struct{ name, before string }{{Day, day}, {Month, month}} {
+		if len(kind.before) == 0 {
+			continue
+		}
+		rs, err := records(txn, ds.NewKey(kind.name).String())
+		if err != nil {
+			return deleted, err
+		}
+		// the layouts sort in time order
+		for _, r := range rs {
+			if r.Period >= kind.before {
+				continue
+			}
+			if err := txn.Delete(recordKey(r.Kind, r.Period, r.Peer, r.Protocol)); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// open opens the ledger datastore in dir. Proxies and the usage command keep it open only
+// while they read or change it, so whoever opens it meanwhile waits for them.
+func open(dir string, readOnly bool) (*leveldb.Datastore, error) {
+	deadline := time.Now().Add(openTimeout)
+	for {
+		store, err := leveldb.NewDatastore(dir, &leveldb.Options{ReadOnly: readOnly})
+		if err == nil {
+			return store, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("open ledger [%s]: %s", dir, err)
+		}
+		time.Sleep(openRetryInterval)
+	}
+}
+
+// update runs f in a transaction of the ledger in dir, committed unless f fails.
+func update(dir string, f func(txn ds.Txn) error) error {
+	store, err := open(dir, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	txn, err := store.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	if err := f(txn); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// Read returns the records of the ledger in dir in period, a day or month,
+// of peer if not empty, sorted by peer and protocol.
+func Read(dir, period, peer string) ([]Record, error) {
+	kind, err := PeriodKind(period)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	store, err := open(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	prefix := ds.KeyWithNamespaces([]string{kind, period})
+	if len(peer) > 0 {
+		prefix = prefix.ChildString(peer)
+	}
+	return records(store, prefix.String())
+}
+
+// Reset deletes the records of the ledger in dir of peer, of all peers if empty, in
+// period, a day or month, or in all periods if empty, and returns how many it deleted.
+// Running proxies check quotas against it once they flush next.
+func Reset(dir, period, peer string) (int, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return 0, nil
+	}
+	deleted := 0
+	err := update(dir, func(txn ds.Txn) error {
+		rs, err := records(txn, "/")
+		if err != nil {
+			return err
+		}
+		for _, r := range rs {
+			if (len(period) > 0 && r.Period != period) || (len(peer) > 0 && r.Peer != peer) {
+				continue
+			}
+			if err := txn.Delete(recordKey(r.Kind, r.Period, r.Peer, r.Protocol)); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
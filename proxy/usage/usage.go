@@ -0,0 +1,334 @@
+// Package usage implements the traffic ledger of proxies, which counts the bytes and streams
+// of endpoint peers per protocol, rolled up per day and month, and enforces volume quotas.
+// The ledger is a leveldb datastore, which the usage command reads and resets.
+package usage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/diandianl/p2p-proxy/config"
+	"github.com/diandianl/p2p-proxy/protocol"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// bytes of a quota, zero is unlimited
+type quota struct {
+	daily, monthly int64
+}
+
+type counterKey struct {
+	peer peer.ID
+
+	protocol protocol.Protocol
+}
+
+// counter holds the usage not saved yet.
+type counter struct {
+	in, out, streams int64
+
+	// open streams counted, guarded by the mutex of the ledger
+	conns int
+}
+
+func (c *counter) take() Usage {
+	return Usage{
+		BytesIn:  atomic.SwapInt64(&c.in, 0),
+		BytesOut: atomic.SwapInt64(&c.out, 0),
+		Streams:  atomic.SwapInt64(&c.streams, 0),
+	}
+}
+
+func (c *counter) putBack(u Usage) {
+	atomic.AddInt64(&c.in, u.BytesIn)
+	atomic.AddInt64(&c.out, u.BytesOut)
+	atomic.AddInt64(&c.streams, u.Streams)
+}
+
+func (c *counter) bytes() int64 {
+	return atomic.LoadInt64(&c.in) + atomic.LoadInt64(&c.out)
+}
+
+// Ledger counts the traffic of streams, a nil *Ledger counts nothing and admits everyone.
+type Ledger struct {
+	path string
+
+	quota quota
+
+	classes map[string]quota
+
+	// days and months of records kept, zero keeps all
+	retainDays, retainMonths int
+
+	// serializes flushes, which do not hold mu while they save
+	flushMu sync.Mutex
+
+	mu sync.Mutex
+
+	counters map[counterKey]*counter
+
+	// bytes per peer saved in the day and month of the last flush
+	daily, monthly map[peer.ID]int64
+
+	// bytes per peer taken by the running flush, not in daily and monthly yet
+	flushing map[peer.ID]int64
+}
+
+// Open opens the ledger of c, nil if it is disabled. The ledger directory is relative to the
+// directory of the config file resolved by resolve.
+func Open(c config.Usage, resolve func(string) (string, error)) (*Ledger, error) {
+	if len(c.Ledger) == 0 {
+		return nil, nil
+	}
+	path, err := resolve(c.Ledger)
+	if err != nil {
+		return nil, err
+	}
+	if c.RetainDays < 0 || c.RetainMonths < 0 {
+		return nil, fmt.Errorf("invalid 'RetainDays' %d or 'RetainMonths' %d", c.RetainDays, c.RetainMonths)
+	}
+	l := &Ledger{
+		path:         path,
+		classes:      make(map[string]quota, len(c.Classes)),
+		retainDays:   c.RetainDays,
+		retainMonths: c.RetainMonths,
+		counters:     make(map[counterKey]*counter),
+	}
+	if l.quota, err = parseQuota(c.Quota); err != nil {
+		return nil, fmt.Errorf("invalid 'Quota': %s", err)
+	}
+	for class, q := range c.Classes {
+		if l.classes[class], err = parseQuota(q); err != nil {
+			return nil, fmt.Errorf("invalid quota of class [%s]: %s", class, err)
+		}
+	}
+	// fails early on unusable ledgers, and loads the totals quotas are checked against
+	if err := l.Flush(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Path returns the directory of the ledger.
+func (l *Ledger) Path() string {
+	return l.path
+}
+
+// Track counts a stream of peer p over protocol proto, and the bytes of its conn c.
+func (l *Ledger) Track(p peer.ID, proto protocol.Protocol, c net.Conn) net.Conn {
+	if l == nil {
+		return c
+	}
+	l.mu.Lock()
+	cnt := l.counter(counterKey{peer: p, protocol: proto})
+	cnt.conns++
+	l.mu.Unlock()
+	atomic.AddInt64(&cnt.streams, 1)
+	return &countedConn{Conn: c, counter: cnt, ledger: l}
+}
+
+// counter returns the counter of key, created if missing. l.mu must be held.
+func (l *Ledger) counter(key counterKey) *counter {
+	cnt, ok := l.counters[key]
+	if !ok {
+		cnt = &counter{}
+		l.counters[key] = cnt
+	}
+	return cnt
+}
+
+// Check returns an error if peer p, whose token has the bandwidth class, empty if none,
+// used up its daily or monthly quota.
+func (l *Ledger) Check(p peer.ID, class string) error {
+	if l == nil {
+		return nil
+	}
+	q, ok := l.classes[class]
+	if !ok || len(class) == 0 {
+		q = l.quota
+	}
+	if q.daily == 0 && q.monthly == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	unsaved := l.flushing[p]
+	for key, cnt := range l.counters {
+		if key.peer == p {
+			unsaved += cnt.bytes()
+		}
+	}
+	if used := l.daily[p] + unsaved; q.daily > 0 && used >= q.daily {
+		return fmt.Errorf("daily quota %s used up", config.FormatSize(q.daily))
+	}
+	if used := l.monthly[p] + unsaved; q.monthly > 0 && used >= q.monthly {
+		return fmt.Errorf("monthly quota %s used up", config.FormatSize(q.monthly))
+	}
+	return nil
+}
+
+// Flush adds the usage counted since the last flush to the records of the current
+// day and month, deletes the records out of retention, and reloads the totals quotas
+// are checked against, which applies resets. Streams are admitted meanwhile.
+func (l *Ledger) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	taken := l.take()
+	now := time.Now()
+	day, month := Periods(now)
+	firstDay, firstMonth := l.retention(now)
+	var daily, monthly map[peer.ID]int64
+	err := update(l.path, func(txn ds.Txn) error {
+		for key, u := range taken {
+			p, proto := peer.Encode(key.peer), string(key.protocol)
+			if err := addUsage(txn, recordKey(Day, day, p, proto), u); err != nil {
+				return err
+			}
+			if err := addUsage(txn, recordKey(Month, month, p, proto), u); err != nil {
+				return err
+			}
+		}
+		if _, err := prune(txn, firstDay, firstMonth); err != nil {
+			return err
+		}
+		var err error
+		if daily, err = peerTotals(txn, Day, day); err != nil {
+			return err
+		}
+		monthly, err = peerTotals(txn, Month, month)
+		return err
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushing = nil
+	if err != nil {
+		// counted again next time
+		for key, u := range taken {
+			l.counter(key).putBack(u)
+		}
+		return err
+	}
+	l.daily, l.monthly = daily, monthly
+	return nil
+}
+
+// take takes the usage counted since the last flush, and drops the counters of
+// peers and protocols without open streams, which count nothing more.
+func (l *Ledger) take() map[counterKey]Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	taken := make(map[counterKey]Usage)
+	l.flushing = make(map[peer.ID]int64)
+	for key, cnt := range l.counters {
+		if cnt.conns == 0 {
+			delete(l.counters, key)
+		}
+		u := cnt.take()
+		if u == (Usage{}) {
+			continue
+		}
+		taken[key] = u
+		l.flushing[key.peer] += u.Bytes()
+	}
+	return taken
+}
+
+// retention returns the first day and month whose records are kept at now, empty if all are.
+func (l *Ledger) retention(now time.Time) (day, month string) {
+	if l.retainDays > 0 {
+		day, _ = Periods(now.AddDate(0, 0, 1-l.retainDays))
+	}
+	if l.retainMonths > 0 {
+		// from the first day, as adding months to the 31st may skip one
+		first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		_, month = Periods(first.AddDate(0, 1-l.retainMonths, 0))
+	}
+	return day, month
+}
+
+// Run flushes the ledger every interval until ctx is done.
+func (l *Ledger) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	if l == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Flush(); err != nil {
+				onError(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// peerTotals sums the bytes of the records in period per peer.
+func peerTotals(store ds.Read, kind, period string) (map[peer.ID]int64, error) {
+	rs, err := records(store, ds.KeyWithNamespaces([]string{kind, period}).String())
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[peer.ID]int64)
+	for _, r := range rs {
+		id, err := peer.Decode(r.Peer)
+		if err != nil {
+			continue
+		}
+		totals[id] += r.Bytes()
+	}
+	return totals, nil
+}
+
+func parseQuota(c config.Quota) (q quota, err error) {
+	if q.daily, err = config.ParseSize(c.Daily); err != nil {
+		return q, err
+	}
+	q.monthly, err = config.ParseSize(c.Monthly)
+	return q, err
+}
+
+// countedConn counts the bytes read from and written to a stream.
+type countedConn struct {
+	net.Conn
+
+	counter *counter
+
+	ledger *Ledger
+
+	closeOnce sync.Once
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.counter.in, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.counter.out, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.ledger.mu.Lock()
+		c.counter.conns--
+		c.ledger.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
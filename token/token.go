@@ -0,0 +1,122 @@
+// Package token implements capability tokens an operator signs to let an endpoint peer
+// use proxies, which verify them offline against the operator public keys.
+package token
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	ErrExpired = errors.New("token expired")
+
+	ErrRevoked = errors.New("token revoked")
+)
+
+// Claims are the signed content of a token.
+type Claims struct {
+	// random id, which revocations name
+	ID string `json:"id"`
+
+	// peer id of the operator key which signed the token
+	Issuer string `json:"iss"`
+
+	// endpoint peer the token was issued to
+	Peer string `json:"peer"`
+
+	// protocols the peer may use, empty for all
+	Protocols []string `json:"protocols,omitempty"`
+
+	// bandwidth class of the peer, empty for the default one
+	Class string `json:"class,omitempty"`
+
+	IssuedAt time.Time `json:"iat"`
+
+	Expiry time.Time `json:"exp"`
+}
+
+// Token is a parsed token, whose signature is not verified yet.
+type Token struct {
+	Claims
+
+	payload, signature []byte
+}
+
+// GenerateKey generates an operator key pair.
+func GenerateKey() (crypto.PrivKey, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	return priv, err
+}
+
+// Issue fills in the id and issuer of c, and returns it signed by the operator key.
+func Issue(key crypto.PrivKey, c Claims) (string, error) {
+	issuer, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	c.ID, c.Issuer = hex.EncodeToString(id[:]), peer.Encode(issuer)
+
+	payload, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	signature, err := key.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return encode(payload) + "." + encode(signature), nil
+}
+
+// Parse decodes a token without verifying it.
+func Parse(s string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %s", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %s", err)
+	}
+	t := &Token{payload: payload, signature: signature}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t.Claims); err != nil {
+		return nil, fmt.Errorf("malformed token: %s", err)
+	}
+	return t, nil
+}
+
+// Allows reports whether the token lets its peer use protocol p.
+func (c *Claims) Allows(p string) bool {
+	if len(c.Protocols) == 0 {
+		return true
+	}
+	for _, allowed := range c.Protocols {
+		if allowed == p {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,149 @@
+package token
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Verifier checks tokens against the operator public keys and the revoked token ids.
+// It is safe for concurrent use.
+type Verifier struct {
+	// operator public keys by their peer id
+	keys map[string]crypto.PubKey
+
+	// file of revoked token ids, empty if none
+	revocationFile string
+
+	// map[string]struct{} of revoked token ids
+	revoked atomic.Value
+}
+
+// NewVerifier returns a verifier of tokens signed by the keys, which are marshaled
+// public keys encoded like the 'P2P.Identity.PrivKey' config.
+func NewVerifier(keys []string, revocationFile string) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string]crypto.PubKey, len(keys)), revocationFile: revocationFile}
+	for _, s := range keys {
+		pub, err := DecodePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operator key [%s]: %s", s, err)
+		}
+		id, err := peer.IDFromPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		v.keys[peer.Encode(id)] = pub
+	}
+	v.revoked.Store(map[string]struct{}{})
+	if len(revocationFile) > 0 {
+		if err := v.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// Verify checks that s is valid and issued to remote for protocol p, and returns its claims.
+func (v *Verifier) Verify(s string, remote peer.ID, p string) (*Claims, error) {
+	t, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Check(t); err != nil {
+		return nil, err
+	}
+	if t.Peer != peer.Encode(remote) {
+		return nil, fmt.Errorf("token issued to another peer [%s]", t.Peer)
+	}
+	if !t.Allows(p) {
+		return nil, fmt.Errorf("token does not allow protocol [%s]", p)
+	}
+	return &t.Claims, nil
+}
+
+// Check checks that t is signed by an operator key, and neither expired nor revoked.
+func (v *Verifier) Check(t *Token) error {
+	pub, ok := v.keys[t.Issuer]
+	if !ok {
+		return fmt.Errorf("unknown token issuer [%s]", t.Issuer)
+	}
+	if ok, err := pub.Verify(t.payload, t.signature); err != nil || !ok {
+		return errors.New("invalid token signature")
+	}
+	if time.Now().After(t.Expiry) {
+		return ErrExpired
+	}
+	if revoked := v.revoked.Load().(map[string]struct{}); len(revoked) > 0 {
+		if _, ok := revoked[t.ID]; ok {
+			return ErrRevoked
+		}
+	}
+	return nil
+}
+
+// RevocationFile returns the file of revoked token ids, empty if none is configured.
+func (v *Verifier) RevocationFile() string {
+	return v.revocationFile
+}
+
+// Reload reads the revocation file again, keeping the current ids if it can not be read.
+// A missing file revokes no token.
+func (v *Verifier) Reload() error {
+	revoked, err := ReadRevocations(v.revocationFile)
+	if err != nil {
+		return err
+	}
+	v.revoked.Store(revoked)
+	return nil
+}
+
+// ReadRevocations reads the token ids of a revocation file, one per line,
+// '#' starting a comment. A missing file has none.
+func ReadRevocations(file string) (map[string]struct{}, error) {
+	revoked := make(map[string]struct{})
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return revoked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			revoked[line] = struct{}{}
+		}
+	}
+	return revoked, scanner.Err()
+}
+
+// DecodePublicKey decodes a marshaled public key encoded like the 'P2P.Identity.PrivKey' config.
+func DecodePublicKey(s string) (crypto.PubKey, error) {
+	b, err := crypto.ConfigDecodeKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPublicKey(b)
+}
+
+// EncodePublicKey encodes pub for the 'Proxy.Tokens.OperatorKeys' config.
+func EncodePublicKey(pub crypto.PubKey) (string, error) {
+	b, err := crypto.MarshalPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return crypto.ConfigEncodeKey(b), nil
+}